@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yanchenm/photo-sync/config"
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+	"github.com/yanchenm/photo-sync/server"
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+const adminUsage = `usage: photo-sync admin <command>
+
+commands:
+  create-user <email> <name>   create a user, reading the password from ADMIN_PASSWORD or standard input
+  delete-user <email>          delete a user along with their photos, albums, shares and links
+  check-config                 report every problem with the configuration
+  sweep                        delete expired uploads and idempotency keys, and retry queued object deletions
+  check-storage [-repair] [-grace 24h]
+                               compare storage with the database, and with -repair delete orphaned objects older
+                               than the grace period and regenerate missing thumbnails`
+
+// ADMIN_DELETE_BATCH is how many photos are loaded at a time while deleting a user's files
+const ADMIN_DELETE_BATCH = 100
+
+func runAdmin(args []string) {
+	if len(args) == 0 {
+		fmt.Println(adminUsage)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "create-user":
+		if len(args) != 3 {
+			fmt.Println(adminUsage)
+			os.Exit(2)
+		}
+
+		database, err := server.OpenDatabase(loadDatabaseConfig().Database)
+		if err != nil {
+			log.Fatalf("error connecting to database: %s", err)
+		}
+
+		defer database.Close()
+
+		if err := createUser(ctx, database, args[1], args[2]); err != nil {
+			log.Fatalf("error creating user: %s", err)
+		}
+
+		fmt.Printf("created user %s\n", args[1])
+	case "delete-user":
+		if len(args) != 2 {
+			fmt.Println(adminUsage)
+			os.Exit(2)
+		}
+
+		cfg := loadDatabaseConfig()
+		if err := cfg.Storage.Validate(); err != nil {
+			log.Fatalf("error loading configuration: %s", err)
+		}
+
+		database, err := server.OpenDatabase(cfg.Database)
+		if err != nil {
+			log.Fatalf("error connecting to database: %s", err)
+		}
+
+		defer database.Close()
+
+		store, err := server.NewStorage(cfg.Storage)
+		if err != nil {
+			log.Fatalf("error connecting to storage: %s", err)
+		}
+
+		count, err := deleteUser(ctx, database, store, args[1])
+		if err != nil {
+			log.Fatalf("error deleting user: %s", err)
+		}
+
+		fmt.Printf("deleted user %s and %d photos\n", args[1], count)
+
+		// Deleting the user queued what their unfinished uploads had staged, which can go straight away
+		if _, err := server.New(cfg, database, store).PurgeDeletedObjects(ctx); err != nil {
+			log.Printf("failed to delete staged uploads, the next sweep will retry them: %s", err)
+		}
+	case "sweep":
+		cfg := loadDatabaseConfig()
+		if err := cfg.Storage.Validate(); err != nil {
+			log.Fatalf("error loading configuration: %s", err)
+		}
+
+		database, err := server.OpenDatabase(cfg.Database)
+		if err != nil {
+			log.Fatalf("error connecting to database: %s", err)
+		}
+
+		defer database.Close()
+
+		store, err := server.NewStorage(cfg.Storage)
+		if err != nil {
+			log.Fatalf("error connecting to storage: %s", err)
+		}
+
+		result, err := server.New(cfg, database, store).Sweep(ctx)
+		fmt.Printf("deleted %d expired uploads and %d expired idempotency keys, purged %d objects\n",
+			result.ExpiredUploads, result.ExpiredIdempotencyKeys, result.PurgedObjects)
+		if err != nil {
+			log.Fatalf("error sweeping storage: %s", err)
+		}
+	case "check-storage":
+		flags := flag.NewFlagSet("check-storage", flag.ExitOnError)
+		repair := flags.Bool("repair", false, "delete orphaned objects and regenerate missing thumbnails")
+		grace := flags.Duration("grace", server.ORPHAN_GRACE_PERIOD, "only delete orphaned objects older than this")
+		flags.Parse(args[1:])
+
+		cfg := loadDatabaseConfig()
+		if err := cfg.Storage.Validate(); err != nil {
+			log.Fatalf("error loading configuration: %s", err)
+		}
+
+		database, err := server.OpenDatabase(cfg.Database)
+		if err != nil {
+			log.Fatalf("error connecting to database: %s", err)
+		}
+
+		defer database.Close()
+
+		store, err := server.NewStorage(cfg.Storage)
+		if err != nil {
+			log.Fatalf("error connecting to storage: %s", err)
+		}
+
+		s := server.New(cfg, database, store)
+		report, err := s.CheckConsistency(ctx, server.ConsistencyOptions{Repair: *repair, GracePeriod: *grace})
+		if err != nil {
+			log.Fatalf("error checking storage: %s", err)
+		}
+
+		printConsistencyReport(report, *grace)
+		if len(report.Errors) > 0 {
+			os.Exit(1)
+		}
+	case "check-config":
+		cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+		if err == nil {
+			err = cfg.Validate()
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("configuration is valid")
+	default:
+		fmt.Println(adminUsage)
+		os.Exit(2)
+	}
+}
+
+func createUser(ctx context.Context, database db.Database, email, name string) error {
+	password := os.Getenv("ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Print("password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read password: %w", err)
+		}
+
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return errors.New("password can't be empty")
+	}
+
+	user := models.User{Email: email, Name: name, Password: password}
+	if err := user.HashPassword(); err != nil {
+		return err
+	}
+
+	return database.AddUser(ctx, &user)
+}
+
+// deleteUser removes the user's files from storage before deleting the user, whose records the database then
+// removes in turn. Files go first so that a failure leaves the user in place for the command to be run again.
+// Objects staged by unfinished uploads are queued for deletion along with the user rather than deleted here.
+func deleteUser(ctx context.Context, database db.Database, store storage.Storage, email string) (int, error) {
+	user, err := database.GetUserFromEmail(ctx, email)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		photos, err := database.GetPhotos(ctx, user, db.PhotoFilter{}, count, ADMIN_DELETE_BATCH)
+		if err != nil {
+			return count, err
+		}
+
+		for _, photo := range photos.Photos {
+			for _, key := range []string{photo.Key, photo.Thumbnail} {
+				if err := store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+					return count, fmt.Errorf("failed to delete %s: %w", key, err)
+				}
+			}
+		}
+
+		count += len(photos.Photos)
+		if len(photos.Photos) < ADMIN_DELETE_BATCH {
+			break
+		}
+	}
+
+	return count, database.DeleteUser(ctx, email)
+}
+
+func printConsistencyReport(report *server.ConsistencyReport, grace time.Duration) {
+	fmt.Printf("checked %d photos and %d objects\n", report.PhotosChecked, report.ObjectsChecked)
+	if report.PurgedObjects > 0 {
+		fmt.Printf("deleted %d objects that were waiting to be deleted\n", report.PurgedObjects)
+	}
+
+	fmt.Printf("\norphaned objects: %d\n", len(report.OrphanedObjects))
+	for _, orphan := range report.OrphanedObjects {
+		status := ""
+		if orphan.Deleted {
+			status = "  deleted"
+		}
+
+		fmt.Printf("  %s  %d bytes  %s%s\n", orphan.Key, orphan.Size, orphan.LastModified.Format(time.RFC3339), status)
+	}
+
+	fmt.Printf("\nphotos missing their original: %d\n", len(report.MissingPhotos))
+	for _, missing := range report.MissingPhotos {
+		fmt.Printf("  %s  %s\n", missing.PhotoID, missing.Key)
+	}
+
+	fmt.Printf("\nmissing thumbnails: %d\n", len(report.MissingThumbnails))
+	for _, missing := range report.MissingThumbnails {
+		status := ""
+		if missing.Regenerated {
+			status = "  regenerated"
+		}
+
+		fmt.Printf("  %s  %s%s\n", missing.PhotoID, missing.Key, status)
+	}
+
+	if len(report.Errors) > 0 {
+		fmt.Printf("\nerrors: %d\n", len(report.Errors))
+		for _, err := range report.Errors {
+			fmt.Printf("  %s\n", err)
+		}
+	}
+
+	if !report.Repair {
+		fmt.Printf("\nnothing was changed, run with -repair to delete orphaned objects older than %s and regenerate thumbnails\n", grace)
+	}
+}
@@ -0,0 +1,515 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting the API needs. It is loaded from an optional YAML or TOML file, and any environment
+// variable that is set takes precedence over the file.
+type Config struct {
+	// Environment is PROD in production, which changes the default CORS origin
+	Environment   string   `yaml:"environment" toml:"environment"`
+	AutoMigrate   bool     `yaml:"auto_migrate" toml:"auto_migrate"`
+	DisableSignUp bool     `yaml:"disable_sign_up" toml:"disable_sign_up"`
+	CORSOrigins   []string `yaml:"cors_origins" toml:"cors_origins"`
+
+	// MetricsToken, if set, must be presented as a bearer token to read /metrics
+	MetricsToken string `yaml:"metrics_token" toml:"metrics_token"`
+
+	// AdminToken must be presented as a bearer token to use the admin endpoints, which are disabled without it
+	AdminToken string `yaml:"admin_token" toml:"admin_token"`
+
+	HTTP     HTTP     `yaml:"http" toml:"http"`
+	Logging  Logging  `yaml:"logging" toml:"logging"`
+	Tracing  Tracing  `yaml:"tracing" toml:"tracing"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Database Database `yaml:"database" toml:"database"`
+	Storage  Storage  `yaml:"storage" toml:"storage"`
+	Upload   Upload   `yaml:"upload" toml:"upload"`
+}
+
+// HTTP configures the standalone server started by the serve command
+type HTTP struct {
+	Addr string `yaml:"addr" toml:"addr"`
+
+	// ReadTimeout and WriteTimeout cover a whole request, so they must allow for the slowest upload
+	ReadTimeout  time.Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+
+	// ShutdownTimeout is how long in-flight requests are given to finish once the server is asked to stop
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	// MaxPageSize caps how many photos a listing returns at once, whatever count the client asks for
+	MaxPageSize int `yaml:"max_page_size" toml:"max_page_size"`
+}
+
+type Logging struct {
+	// Level is one of trace, debug, info, warn or error
+	Level string `yaml:"level" toml:"level"`
+
+	// Format is json, for log collectors, or text, for reading in a terminal
+	Format string `yaml:"format" toml:"format"`
+}
+
+// Tracing configures OpenTelemetry. The OTLP endpoint and headers are read by the exporter itself from the
+// standard OTEL_EXPORTER_OTLP_* environment variables.
+type Tracing struct {
+	// Exporter is none, otlp, or stdout for local runs
+	Exporter string `yaml:"exporter" toml:"exporter"`
+
+	// SampleRatio is the fraction of new traces that are recorded. Requests that arrive with a sampled parent are
+	// always recorded.
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+}
+
+type Auth struct {
+	AccessTokenKey       string        `yaml:"access_token_key" toml:"access_token_key"`
+	RefreshTokenKey      string        `yaml:"refresh_token_key" toml:"refresh_token_key"`
+	AccessTokenLifetime  time.Duration `yaml:"access_token_lifetime" toml:"access_token_lifetime"`
+	RefreshTokenLifetime time.Duration `yaml:"refresh_token_lifetime" toml:"refresh_token_lifetime"`
+}
+
+type Database struct {
+	// Driver is postgres or sqlite
+	Driver string `yaml:"driver" toml:"driver"`
+
+	// URL is a complete Postgres connection string that replaces the individual connection settings
+	URL         string `yaml:"url" toml:"url"`
+	Host        string `yaml:"host" toml:"host"`
+	Port        int    `yaml:"port" toml:"port"`
+	User        string `yaml:"user" toml:"user"`
+	Password    string `yaml:"password" toml:"password"`
+	Name        string `yaml:"name" toml:"name"`
+	SSLMode     string `yaml:"ssl_mode" toml:"ssl_mode"`
+	SSLRootCert string `yaml:"ssl_root_cert" toml:"ssl_root_cert"`
+
+	SQLitePath string `yaml:"sqlite_path" toml:"sqlite_path"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	QueryTimeout    time.Duration `yaml:"query_timeout" toml:"query_timeout"`
+}
+
+type Storage struct {
+	// Backend is s3, local or memory
+	Backend string `yaml:"backend" toml:"backend"`
+
+	Region string `yaml:"region" toml:"region"`
+	Bucket string `yaml:"bucket" toml:"bucket"`
+
+	Path       string `yaml:"path" toml:"path"`
+	URL        string `yaml:"url" toml:"url"`
+	SigningKey string `yaml:"signing_key" toml:"signing_key"`
+}
+
+type Upload struct {
+	// MaxSize is the largest photo accepted, in bytes, however it is uploaded
+	MaxSize int64 `yaml:"max_size" toml:"max_size"`
+
+	// ThumbnailSize is the largest width or height of a generated thumbnail, in pixels
+	ThumbnailSize int `yaml:"thumbnail_size" toml:"thumbnail_size"`
+
+	// BatchWorkers is how many photos of a batch upload are processed at the same time
+	BatchWorkers int `yaml:"batch_workers" toml:"batch_workers"`
+
+	// MaxBatchFiles is the most photos accepted in a single batch upload
+	MaxBatchFiles int `yaml:"max_batch_files" toml:"max_batch_files"`
+}
+
+// Default returns the configuration used for anything that isn't set in the file or environment
+func Default() Config {
+	return Config{
+		DisableSignUp: true,
+		HTTP: HTTP{
+			Addr:            ":8080",
+			ReadTimeout:     5 * time.Minute,
+			WriteTimeout:    5 * time.Minute,
+			IdleTimeout:     2 * time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+			MaxPageSize:     500,
+		},
+		Logging: Logging{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "photo-sync",
+		},
+		Auth: Auth{
+			AccessTokenLifetime:  15 * time.Minute,
+			RefreshTokenLifetime: 14 * 24 * time.Hour,
+		},
+		Database: Database{
+			Driver:       "postgres",
+			Host:         "database",
+			Port:         5432,
+			SSLMode:      "disable",
+			QueryTimeout: 10 * time.Second,
+		},
+		Storage: Storage{
+			Backend: "s3",
+		},
+		Upload: Upload{
+			MaxSize:       50 << 20,
+			ThumbnailSize: 600,
+			BatchWorkers:  4,
+			MaxBatchFiles: 200,
+		},
+	}
+}
+
+// Load reads the configuration file at path, if one is given, and then applies the environment on top of it.
+// The result is not validated so that commands which only need part of it can still run.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := readFile(path, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+
+	if len(cfg.CORSOrigins) == 0 {
+		cfg.CORSOrigins = []string{"http://localhost:3000"}
+		if cfg.Production() {
+			cfg.CORSOrigins = []string{"https://photos.runny.cloud"}
+		}
+	}
+
+	return cfg, nil
+}
+
+func readFile(path string, cfg *Config) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(contents))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(contents), cfg)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %s", meta.Undecoded()[0])
+		}
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml, not %q", path, ext)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv overrides settings with the environment variables that are set
+func (cfg *Config) applyEnv() error {
+	env := envReader{}
+
+	env.string("ENVIRONMENT", &cfg.Environment)
+	env.bool("AUTO_MIGRATE", &cfg.AutoMigrate)
+	env.bool("DISABLE_SIGN_UP", &cfg.DisableSignUp)
+	env.list("CORS_ORIGINS", &cfg.CORSOrigins)
+	env.string("METRICS_TOKEN", &cfg.MetricsToken)
+	env.string("ADMIN_TOKEN", &cfg.AdminToken)
+
+	env.string("LISTEN_ADDR", &cfg.HTTP.Addr)
+	env.duration("HTTP_READ_TIMEOUT", &cfg.HTTP.ReadTimeout)
+	env.duration("HTTP_WRITE_TIMEOUT", &cfg.HTTP.WriteTimeout)
+	env.duration("HTTP_IDLE_TIMEOUT", &cfg.HTTP.IdleTimeout)
+	env.duration("SHUTDOWN_TIMEOUT", &cfg.HTTP.ShutdownTimeout)
+	env.int("MAX_PAGE_SIZE", &cfg.HTTP.MaxPageSize)
+
+	env.string("LOG_LEVEL", &cfg.Logging.Level)
+	env.string("LOG_FORMAT", &cfg.Logging.Format)
+
+	env.string("TRACING_EXPORTER", &cfg.Tracing.Exporter)
+	env.float("TRACING_SAMPLE_RATIO", &cfg.Tracing.SampleRatio)
+	env.string("OTEL_SERVICE_NAME", &cfg.Tracing.ServiceName)
+
+	env.string("ACCESS_TOKEN_KEY", &cfg.Auth.AccessTokenKey)
+	env.string("REFRESH_TOKEN_KEY", &cfg.Auth.RefreshTokenKey)
+	env.duration("ACCESS_TOKEN_LIFETIME", &cfg.Auth.AccessTokenLifetime)
+	env.duration("REFRESH_TOKEN_LIFETIME", &cfg.Auth.RefreshTokenLifetime)
+
+	env.string("DATABASE_DRIVER", &cfg.Database.Driver)
+	env.string("DATABASE_URL", &cfg.Database.URL)
+	env.string("POSTGRES_HOST", &cfg.Database.Host)
+	env.int("POSTGRES_PORT", &cfg.Database.Port)
+	env.string("POSTGRES_USER", &cfg.Database.User)
+	env.string("POSTGRES_PASSWORD", &cfg.Database.Password)
+	env.string("POSTGRES_DB", &cfg.Database.Name)
+	env.string("POSTGRES_SSLMODE", &cfg.Database.SSLMode)
+	env.string("POSTGRES_SSLROOTCERT", &cfg.Database.SSLRootCert)
+	env.string("SQLITE_PATH", &cfg.Database.SQLitePath)
+	env.int("DB_MAX_OPEN_CONNS", &cfg.Database.MaxOpenConns)
+	env.int("DB_MAX_IDLE_CONNS", &cfg.Database.MaxIdleConns)
+	env.duration("DB_CONN_MAX_LIFETIME", &cfg.Database.ConnMaxLifetime)
+	env.duration("DB_QUERY_TIMEOUT", &cfg.Database.QueryTimeout)
+
+	env.string("STORAGE_BACKEND", &cfg.Storage.Backend)
+	env.string("AWS_REGION", &cfg.Storage.Region)
+	env.string("S3_BUCKET", &cfg.Storage.Bucket)
+	env.string("STORAGE_PATH", &cfg.Storage.Path)
+	env.string("STORAGE_URL", &cfg.Storage.URL)
+	env.string("STORAGE_SIGNING_KEY", &cfg.Storage.SigningKey)
+
+	env.int64("UPLOAD_MAX_SIZE", &cfg.Upload.MaxSize)
+	env.int("THUMBNAIL_SIZE", &cfg.Upload.ThumbnailSize)
+	env.int("UPLOAD_BATCH_WORKERS", &cfg.Upload.BatchWorkers)
+	env.int("UPLOAD_MAX_BATCH_FILES", &cfg.Upload.MaxBatchFiles)
+
+	return env.err()
+}
+
+// Production reports whether the API is running in the production environment
+func (cfg Config) Production() bool {
+	return cfg.Environment == "PROD"
+}
+
+// Validate checks the settings needed to run the server and reports every problem at once
+func (cfg Config) Validate() error {
+	var problems []string
+
+	if cfg.Auth.AccessTokenKey == "" {
+		problems = append(problems, "ACCESS_TOKEN_KEY is required")
+	}
+
+	if cfg.Auth.RefreshTokenKey == "" {
+		problems = append(problems, "REFRESH_TOKEN_KEY is required")
+	}
+
+	if cfg.Auth.AccessTokenKey != "" && cfg.Auth.AccessTokenKey == cfg.Auth.RefreshTokenKey {
+		problems = append(problems, "ACCESS_TOKEN_KEY and REFRESH_TOKEN_KEY must be different")
+	}
+
+	if cfg.Auth.AccessTokenLifetime <= 0 || cfg.Auth.RefreshTokenLifetime <= 0 {
+		problems = append(problems, "token lifetimes must be positive")
+	}
+
+	if len(cfg.CORSOrigins) == 0 {
+		problems = append(problems, "at least one CORS origin is required")
+	}
+
+	if cfg.HTTP.ReadTimeout < 0 || cfg.HTTP.WriteTimeout < 0 || cfg.HTTP.IdleTimeout < 0 || cfg.HTTP.ShutdownTimeout < 0 {
+		problems = append(problems, "HTTP timeouts can't be negative")
+	}
+
+	if cfg.HTTP.MaxPageSize <= 0 {
+		problems = append(problems, "MAX_PAGE_SIZE must be positive")
+	}
+
+	if cfg.Logging.Format != "json" && cfg.Logging.Format != "text" {
+		problems = append(problems, fmt.Sprintf("LOG_FORMAT must be json or text, not %q", cfg.Logging.Format))
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	default:
+		problems = append(problems, fmt.Sprintf("TRACING_EXPORTER must be none, otlp or stdout, not %q", cfg.Tracing.Exporter))
+	}
+
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		problems = append(problems, "TRACING_SAMPLE_RATIO must be between 0 and 1")
+	}
+
+	problems = append(problems, cfg.Database.problems()...)
+	problems = append(problems, cfg.Storage.problems()...)
+
+	if cfg.Upload.MaxSize <= 0 {
+		problems = append(problems, "UPLOAD_MAX_SIZE must be positive")
+	}
+
+	if cfg.Upload.ThumbnailSize <= 0 {
+		problems = append(problems, "THUMBNAIL_SIZE must be positive")
+	}
+
+	if cfg.Upload.BatchWorkers <= 0 {
+		problems = append(problems, "UPLOAD_BATCH_WORKERS must be positive")
+	}
+
+	if cfg.Upload.MaxBatchFiles <= 0 {
+		problems = append(problems, "UPLOAD_MAX_BATCH_FILES must be positive")
+	}
+
+	return invalid(problems)
+}
+
+// Validate checks only the database settings, for commands that don't start the server
+func (d Database) Validate() error {
+	return invalid(d.problems())
+}
+
+// Validate checks only the storage settings, for commands that don't start the server
+func (s Storage) Validate() error {
+	return invalid(s.problems())
+}
+
+func (d Database) problems() []string {
+	var problems []string
+
+	switch d.Driver {
+	case "postgres":
+		if d.URL == "" && (d.User == "" || d.Name == "") {
+			problems = append(problems, "POSTGRES_USER and POSTGRES_DB are required unless DATABASE_URL is set")
+		}
+	case "sqlite":
+		if d.SQLitePath == "" {
+			problems = append(problems, "SQLITE_PATH is required for the sqlite driver")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown DATABASE_DRIVER %q", d.Driver))
+	}
+
+	if d.MaxOpenConns < 0 || d.MaxIdleConns < 0 || d.ConnMaxLifetime < 0 || d.QueryTimeout < 0 {
+		problems = append(problems, "database pool limits and timeouts can't be negative")
+	}
+
+	return problems
+}
+
+func (s Storage) problems() []string {
+	var problems []string
+
+	switch s.Backend {
+	case "s3":
+		if s.Region == "" || s.Bucket == "" {
+			problems = append(problems, "AWS_REGION and S3_BUCKET are required for the s3 storage backend")
+		}
+	case "local":
+		if s.Path == "" || s.URL == "" || s.SigningKey == "" {
+			problems = append(problems, "STORAGE_PATH, STORAGE_URL and STORAGE_SIGNING_KEY are required for the local storage backend")
+		}
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown STORAGE_BACKEND %q", s.Backend))
+	}
+
+	return problems
+}
+
+func invalid(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// envReader applies environment variables to settings and collects every value that fails to parse
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) lookup(name string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	return value, ok && value != ""
+}
+
+func (e *envReader) string(name string, dest *string) {
+	if value, ok := e.lookup(name); ok {
+		*dest = value
+	}
+}
+
+func (e *envReader) list(name string, dest *[]string) {
+	value, ok := e.lookup(name)
+	if !ok {
+		return
+	}
+
+	*dest = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*dest = append(*dest, item)
+		}
+	}
+}
+
+func (e *envReader) bool(name string, dest *bool) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s must be true or false, got %q", name, value))
+			return
+		}
+
+		*dest = parsed
+	}
+}
+
+func (e *envReader) int(name string, dest *int) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s must be an integer, got %q", name, value))
+			return
+		}
+
+		*dest = parsed
+	}
+}
+
+func (e *envReader) int64(name string, dest *int64) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s must be an integer, got %q", name, value))
+			return
+		}
+
+		*dest = parsed
+	}
+}
+
+func (e *envReader) float(name string, dest *float64) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s must be a number, got %q", name, value))
+			return
+		}
+
+		*dest = parsed
+	}
+}
+
+func (e *envReader) duration(name string, dest *time.Duration) {
+	if value, ok := e.lookup(name); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			e.problems = append(e.problems, fmt.Sprintf("%s must be a duration such as 30s, got %q", name, value))
+			return
+		}
+
+		*dest = parsed
+	}
+}
+
+func (e *envReader) err() error {
+	return invalid(e.problems)
+}
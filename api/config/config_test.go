@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file with the given name to a temporary directory and returns its path
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %s", err)
+	}
+
+	return path
+}
+
+// validConfig is a configuration that passes Validate
+func validConfig() Config {
+	cfg := Default()
+	cfg.CORSOrigins = []string{"http://localhost:3000"}
+	cfg.Auth.AccessTokenKey = "access"
+	cfg.Auth.RefreshTokenKey = "refresh"
+	cfg.Database.Driver = "sqlite"
+	cfg.Database.SQLitePath = "photos.db"
+	cfg.Storage.Backend = "memory"
+	return cfg
+}
+
+func TestLoadAppliesEnvOverFile(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+http:
+  addr: ":9000"
+  read_timeout: 1m
+logging:
+  level: debug
+upload:
+  max_size: 1024
+`,
+		"config.toml": `
+[http]
+addr = ":9000"
+read_timeout = "1m"
+
+[logging]
+level = "debug"
+
+[upload]
+max_size = 1024
+`,
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+			path := writeConfig(t, name, contents)
+			t.Setenv("LISTEN_ADDR", ":9100")
+			t.Setenv("UPLOAD_MAX_SIZE", "2048")
+
+			// An empty variable counts as unset rather than clearing the file's setting
+			t.Setenv("LOG_LEVEL", "")
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatalf("failed to load config: %s", err)
+			}
+
+			if cfg.HTTP.Addr != ":9100" || cfg.Upload.MaxSize != 2048 {
+				t.Errorf("expected the environment to override the file, got addr %q and max size %d", cfg.HTTP.Addr, cfg.Upload.MaxSize)
+			}
+
+			if cfg.HTTP.ReadTimeout != time.Minute || cfg.Logging.Level != "debug" {
+				t.Errorf("expected the file to override the defaults, got read timeout %s and level %q", cfg.HTTP.ReadTimeout, cfg.Logging.Level)
+			}
+
+			if cfg.HTTP.WriteTimeout != Default().HTTP.WriteTimeout {
+				t.Errorf("expected settings missing from both to keep their default, got write timeout %s", cfg.HTTP.WriteTimeout)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidFiles(t *testing.T) {
+	files := map[string]string{
+		"unknown.yaml": "http:\n  address: \":9000\"\n",
+		"unknown.toml": "[http]\naddress = \":9000\"\n",
+		"config.json":  "{}",
+	}
+
+	for name, contents := range files {
+		if _, err := Load(writeConfig(t, name, contents)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadReportsEveryInvalidVariable(t *testing.T) {
+	t.Setenv("UPLOAD_MAX_SIZE", "big")
+	t.Setenv("AUTO_MIGRATE", "sometimes")
+
+	_, err := Load("")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, name := range []string{"UPLOAD_MAX_SIZE", "AUTO_MIGRATE"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected the error to mention %s, got %s", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatalf("expected a valid configuration, got %s", err)
+	}
+
+	tests := map[string]struct {
+		edit    func(*Config)
+		problem string
+	}{
+		"missing key":         {func(cfg *Config) { cfg.Auth.AccessTokenKey = "" }, "ACCESS_TOKEN_KEY is required"},
+		"same keys":           {func(cfg *Config) { cfg.Auth.RefreshTokenKey = cfg.Auth.AccessTokenKey }, "must be different"},
+		"page size":           {func(cfg *Config) { cfg.HTTP.MaxPageSize = 0 }, "MAX_PAGE_SIZE"},
+		"log format":          {func(cfg *Config) { cfg.Logging.Format = "xml" }, "LOG_FORMAT"},
+		"sample ratio":        {func(cfg *Config) { cfg.Tracing.SampleRatio = 2 }, "TRACING_SAMPLE_RATIO"},
+		"database driver":     {func(cfg *Config) { cfg.Database.Driver = "mysql" }, "DATABASE_DRIVER"},
+		"sqlite path":         {func(cfg *Config) { cfg.Database.SQLitePath = "" }, "SQLITE_PATH"},
+		"postgres database":   {func(cfg *Config) { cfg.Database.Driver = "postgres" }, "POSTGRES_USER"},
+		"local storage":       {func(cfg *Config) { cfg.Storage.Backend = "local" }, "STORAGE_PATH"},
+		"upload size":         {func(cfg *Config) { cfg.Upload.MaxSize = 0 }, "UPLOAD_MAX_SIZE"},
+		"negative query time": {func(cfg *Config) { cfg.Database.QueryTimeout = -time.Second }, "can't be negative"},
+	}
+
+	for name, test := range tests {
+		cfg := validConfig()
+		test.edit(&cfg)
+
+		err := cfg.Validate()
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: expected an error mentioning %q, got %v", name, test.problem, err)
+		}
+	}
+
+	// Every problem is reported at once
+	cfg := validConfig()
+	cfg.Auth.AccessTokenKey = ""
+	cfg.Upload.MaxSize = 0
+
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "ACCESS_TOKEN_KEY") || !strings.Contains(err.Error(), "UPLOAD_MAX_SIZE") {
+		t.Errorf("expected both problems to be reported, got %v", err)
+	}
+}
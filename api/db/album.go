@@ -0,0 +1,288 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// The cover of an album is the photo chosen by the user or, if none has been chosen, the first photo in the album
+const albumSelect = `
+SELECT a.id, a.username, a.name, a.created_at, p.id, p.thumbnail,
+       (SELECT COUNT(*) FROM album_photos ap WHERE ap.album_id = a.id)
+FROM albums a
+LEFT JOIN photos p ON p.id = COALESCE(a.cover,
+    (SELECT ap.photo_id FROM album_photos ap WHERE ap.album_id = a.id ORDER BY ap.position LIMIT 1))`
+
+func scanAlbum(row scanner) (models.Album, error) {
+	album := models.Album{}
+	var cover, coverThumbnail sql.NullString
+
+	err := row.Scan(&album.ID, &album.User, &album.Name, &album.CreatedAt, &cover, &coverThumbnail, &album.Count)
+	album.Cover = cover.String
+	album.CoverThumbnail = coverThumbnail.String
+
+	return album, err
+}
+
+func (db Database) GetAlbums(ctx context.Context, user models.User) (*models.AlbumList, error) {
+	ctx, end := db.begin(ctx, "GetAlbums")
+	defer end()
+
+	res := &models.AlbumList{}
+	query := albumSelect + ` WHERE a.username = $1 ORDER BY a.created_at DESC;`
+
+	rows, err := db.Conn.QueryContext(ctx, query, user.Email)
+	if err != nil {
+		return res, translateError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		album, err := scanAlbum(rows)
+		if err != nil {
+			return res, translateError(err)
+		}
+
+		res.Albums = append(res.Albums, album)
+	}
+
+	return res, translateError(rows.Err())
+}
+
+func (db Database) GetAlbumById(ctx context.Context, id string) (models.Album, error) {
+	ctx, end := db.begin(ctx, "GetAlbumById")
+	defer end()
+
+	query := albumSelect + ` WHERE a.id = $1;`
+	album, err := scanAlbum(db.Conn.QueryRowContext(ctx, query, id))
+
+	return album, translateError(err)
+}
+
+func (db Database) GetAlbumPhotos(ctx context.Context, id string) (*models.PhotoList, error) {
+	ctx, end := db.begin(ctx, "GetAlbumPhotos")
+	defer end()
+
+	res := &models.PhotoList{}
+	query := photoSelect + ` FROM photos p LEFT JOIN details d ON d.id = p.id
+		JOIN album_photos ap ON ap.photo_id = p.id WHERE ap.album_id = $1 ORDER BY ap.position;`
+
+	rows, err := db.Conn.QueryContext(ctx, query, id)
+	if err != nil {
+		return res, translateError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			return res, translateError(err)
+		}
+
+		res.Photos = append(res.Photos, photo)
+	}
+
+	return res, translateError(rows.Err())
+}
+
+// AddAlbum creates an album along with its first photos, so that a failure leaves no album behind
+func (db Database) AddAlbum(ctx context.Context, album *models.Album, photoIds []string) error {
+	ctx, end := db.begin(ctx, "AddAlbum")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	var createdAt string
+
+	query := `INSERT INTO albums (id, username, name) VALUES ($1, $2, $3) RETURNING created_at;`
+	err = tx.QueryRowContext(ctx, query, album.ID, album.User, album.Name).Scan(&createdAt)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := appendAlbumPhotos(ctx, tx, album.ID, photoIds); err != nil {
+		return translateError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return translateError(err)
+	}
+
+	album.CreatedAt = createdAt
+	return nil
+}
+
+func (db Database) RenameAlbum(ctx context.Context, id, name string) error {
+	ctx, end := db.begin(ctx, "RenameAlbum")
+	defer end()
+
+	query := `UPDATE albums SET name = $2 WHERE id = $1;`
+	res, err := db.Conn.ExecContext(ctx, query, id, name)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return expectRows(res)
+}
+
+func (db Database) DeleteAlbum(ctx context.Context, id string) error {
+	ctx, end := db.begin(ctx, "DeleteAlbum")
+	defer end()
+
+	query := `DELETE FROM albums WHERE id = $1;`
+	res, err := db.Conn.ExecContext(ctx, query, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return expectRows(res)
+}
+
+// AddPhotosToAlbum appends photos to the end of an album, skipping any that are already in it
+func (db Database) AddPhotosToAlbum(ctx context.Context, id string, photoIds []string) error {
+	ctx, end := db.begin(ctx, "AddPhotosToAlbum")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	// Touching the album first holds its row lock until the photos are added, so that concurrent additions wait for
+	// each other instead of appending at the same position
+	res, err := tx.ExecContext(ctx, `UPDATE albums SET name = name WHERE id = $1;`, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := expectRows(res); err != nil {
+		return err
+	}
+
+	if err := appendAlbumPhotos(ctx, tx, id, photoIds); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// appendAlbumPhotos adds photos after the last photo of an album within tx, skipping any that are already in it
+func appendAlbumPhotos(ctx context.Context, tx *sql.Tx, id string, photoIds []string) error {
+	if len(photoIds) == 0 {
+		return nil
+	}
+
+	var position int
+	query := `SELECT COALESCE(MAX(position), -1) FROM album_photos WHERE album_id = $1;`
+	if err := tx.QueryRowContext(ctx, query, id).Scan(&position); err != nil {
+		return err
+	}
+
+	insert := `INSERT INTO album_photos (album_id, photo_id, position) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`
+	for _, photoId := range photoIds {
+		res, err := tx.ExecContext(ctx, insert, id, photoId, position+1)
+		if err != nil {
+			return err
+		}
+
+		if n, _ := res.RowsAffected(); n > 0 {
+			position++
+		}
+	}
+
+	return nil
+}
+
+func (db Database) RemovePhotoFromAlbum(ctx context.Context, id, photoId string) error {
+	ctx, end := db.begin(ctx, "RemovePhotoFromAlbum")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	query := `DELETE FROM album_photos WHERE album_id = $1 AND photo_id = $2;`
+	res, err := tx.ExecContext(ctx, query, id, photoId)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := expectRows(res); err != nil {
+		return err
+	}
+
+	// Fall back to the default cover if the chosen cover was removed
+	query = `UPDATE albums SET cover = NULL WHERE id = $1 AND cover = $2;`
+	if _, err := tx.ExecContext(ctx, query, id, photoId); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// ReorderAlbum sets the position of each photo in the album to its index in photoIds
+func (db Database) ReorderAlbum(ctx context.Context, id string, photoIds []string) error {
+	ctx, end := db.begin(ctx, "ReorderAlbum")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	query := `UPDATE album_photos SET position = $3 WHERE album_id = $1 AND photo_id = $2;`
+	for i, photoId := range photoIds {
+		res, err := tx.ExecContext(ctx, query, id, photoId, i)
+		if err != nil {
+			return translateError(err)
+		}
+
+		if err := expectRows(res); err != nil {
+			return err
+		}
+	}
+
+	return translateError(tx.Commit())
+}
+
+// SetAlbumCover chooses the cover of an album, which must be one of its photos. An empty photoId resets the
+// cover to the first photo of the album.
+func (db Database) SetAlbumCover(ctx context.Context, id, photoId string) error {
+	ctx, end := db.begin(ctx, "SetAlbumCover")
+	defer end()
+
+	if photoId == "" {
+		query := `UPDATE albums SET cover = NULL WHERE id = $1;`
+		res, err := db.Conn.ExecContext(ctx, query, id)
+		if err != nil {
+			return translateError(err)
+		}
+
+		return expectRows(res)
+	}
+
+	query := `UPDATE albums SET cover = $2 WHERE id = $1
+		AND EXISTS (SELECT 1 FROM album_photos WHERE album_id = $1 AND photo_id = $2);`
+	res, err := db.Conn.ExecContext(ctx, query, id, photoId)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return expectRows(res)
+}
@@ -1,35 +1,41 @@
 package db
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
 
 	"github.com/yanchenm/photo-sync/models"
 )
 
-func (db Database) AddToken(token models.RefreshToken) error {
+func (db Database) AddToken(ctx context.Context, token models.RefreshToken) error {
+	ctx, end := db.begin(ctx, "AddToken")
+	defer end()
+
 	query := `INSERT INTO auth (email, token) VALUES ($1, $2);`
-	_, err := db.Conn.Exec(query, token.Email, token.Token)
-	return err
+	_, err := db.Conn.ExecContext(ctx, query, token.Email, token.Token)
+	return translateError(err)
 }
 
-func (db Database) TokenValid(token models.RefreshToken) bool {
+func (db Database) TokenValid(ctx context.Context, token models.RefreshToken) bool {
+	ctx, end := db.begin(ctx, "TokenValid")
+	defer end()
+
 	dbToken := models.RefreshToken{}
 	query := `SELECT * FROM auth WHERE email = $1 AND token = $2;`
 
-	row := db.Conn.QueryRow(query, token.Email, token.Token)
+	row := db.Conn.QueryRowContext(ctx, query, token.Email, token.Token)
 	err := row.Scan(&dbToken.Email, &dbToken.Token)
 	return err == nil
 }
 
-func (db Database) DeleteToken(token models.RefreshToken) error {
-	query := `DELETE FROM auth WHERE email = $1 AND token = $2;`
-	_, err := db.Conn.Exec(query, token.Email, token.Token)
+func (db Database) DeleteToken(ctx context.Context, token models.RefreshToken) error {
+	ctx, end := db.begin(ctx, "DeleteToken")
+	defer end()
 
-	switch err {
-	case sql.ErrNoRows:
-		return fmt.Errorf("no matching record")
-	default:
-		return err
+	query := `DELETE FROM auth WHERE email = $1 AND token = $2;`
+	res, err := db.Conn.ExecContext(ctx, query, token.Email, token.Token)
+	if err != nil {
+		return translateError(err)
 	}
+
+	return expectRows(res)
 }
@@ -1,28 +1,148 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	_ "modernc.org/sqlite"
 )
 
+var tracer = otel.Tracer("github.com/yanchenm/photo-sync/db")
+
+// Dialect is the SQL database a Database talks to. Queries are written for Postgres and only differ where SQLite
+// has no equivalent.
+type Dialect string
+
 const (
-	HOST = "database"
-	PORT = 5432
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
 )
 
+// timeExpr normalizes a timestamp expression so that it compares correctly. SQLite stores timestamps as text,
+// which only sorts chronologically when every value has the same format.
+func (d Dialect) timeExpr(expr string) string {
+	if d == SQLite {
+		return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:%%M:%%f', %s)", expr)
+	}
+
+	return expr
+}
+
+// Config describes how to connect to the database. For Postgres, DSN takes precedence over the individual
+// connection settings when it is set.
+type Config struct {
+	Driver Dialect
+
+	DSN         string
+	Host        string
+	Port        int
+	User        string
+	Password    string
+	Name        string
+	SSLMode     string
+	SSLRootCert string
+
+	// SQLitePath is the database file used by the SQLite driver
+	SQLitePath string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// QueryTimeout bounds every query on top of any deadline the caller's context already has
+	QueryTimeout time.Duration
+}
+
+// postgresDataSource builds a lib/pq connection string, quoting values so that passwords may contain spaces
+func (c Config) postgresDataSource() string {
+	if c.DSN != "" {
+		return c.DSN
+	}
+
+	port := ""
+	if c.Port > 0 {
+		port = strconv.Itoa(c.Port)
+	}
+
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"host", c.Host},
+		{"port", port},
+		{"user", c.User},
+		{"password", c.Password},
+		{"dbname", c.Name},
+		{"sslmode", c.SSLMode},
+		{"sslrootcert", c.SSLRootCert},
+	}
+
+	var parts []string
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(setting.value)
+		parts = append(parts, fmt.Sprintf("%s='%s'", setting.key, value))
+	}
+
+	return strings.Join(parts, " ")
+}
+
 type Database struct {
-	Conn *sql.DB
+	Conn         *sql.DB
+	Dialect      Dialect
+	QueryTimeout time.Duration
+}
+
+// Initialize connects to the database described by cfg and applies its pool limits
+func Initialize(cfg Config) (Database, error) {
+	var db Database
+	var err error
+
+	switch cfg.Driver {
+	case Postgres, "":
+		db, err = initializePostgres(cfg)
+	case SQLite:
+		db, err = initializeSQLite(cfg.SQLitePath)
+	default:
+		return db, fmt.Errorf("unknown database driver %q", cfg.Driver)
+	}
+
+	if err != nil {
+		return db, err
+	}
+
+	// An in-memory SQLite database only exists on its single connection, so its limit can't be raised
+	if cfg.MaxOpenConns > 0 && cfg.SQLitePath != ":memory:" {
+		db.Conn.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+
+	if cfg.MaxIdleConns > 0 {
+		db.Conn.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+
+	db.Conn.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	db.QueryTimeout = cfg.QueryTimeout
+
+	return db, nil
 }
 
-func Initialize(username, password, database string) (Database, error) {
-	db := Database{}
-	dataSource := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		HOST, PORT, username, password, database)
+func initializePostgres(cfg Config) (Database, error) {
+	db := Database{Dialect: Postgres}
 
-	conn, err := sql.Open("postgres", dataSource)
+	conn, err := sql.Open("postgres", cfg.postgresDataSource())
 	if err != nil {
 		return db, err
 	}
@@ -36,3 +156,112 @@ func Initialize(username, password, database string) (Database, error) {
 	log.Info("database connection established")
 	return db, nil
 }
+
+// initializeSQLite opens the SQLite database at path, creating it if it doesn't exist. A path of :memory: opens a
+// private in-memory database, which is useful for tests.
+func initializeSQLite(path string) (Database, error) {
+	db := Database{Dialect: SQLite}
+	dataSource := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite", path)
+
+	conn, err := sql.Open("sqlite", dataSource)
+	if err != nil {
+		return db, err
+	}
+
+	if path == ":memory:" {
+		// Every connection to :memory: gets its own database, so only ever use one
+		conn.SetMaxOpenConns(1)
+	} else if _, err := conn.Exec(`PRAGMA journal_mode = WAL;`); err != nil {
+		return db, err
+	}
+
+	db.Conn = conn
+	err = db.Conn.Ping()
+	if err != nil {
+		return db, err
+	}
+
+	log.Infof("sqlite database %s opened", path)
+	return db, nil
+}
+
+// begin starts a span for a database method and bounds its queries by the query timeout. Callers must call end
+// once they are done with any rows the queries returned.
+func (db Database) begin(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, func()) {
+	system := semconv.DBSystemPostgreSQL
+	if db.Dialect == SQLite {
+		system = semconv.DBSystemSqlite
+	}
+
+	attrs = append(attrs, system, semconv.DBOperation(method))
+	ctx, span := tracer.Start(ctx, "db."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	ctx, cancel := db.withTimeout(ctx)
+
+	return ctx, func() {
+		cancel()
+		span.End()
+	}
+}
+
+// photoAttribute identifies the photo a span is about, using the same name as the request logs
+func photoAttribute(id string) attribute.KeyValue {
+	return attribute.String("photo_id", id)
+}
+
+// withTimeout bounds a query by the configured query timeout. Callers must call cancel once they are done with any
+// rows the query returned.
+func (db Database) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if db.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
+// Ping checks that the database is reachable
+func (db Database) Ping(ctx context.Context) error {
+	ctx, end := db.begin(ctx, "Ping")
+	defer end()
+
+	return db.Conn.PingContext(ctx)
+}
+
+// Stats returns the connection pool statistics
+func (db Database) Stats() sql.DBStats {
+	return db.Conn.Stats()
+}
+
+func (db Database) Close() error {
+	return db.Conn.Close()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// querier is a connection or transaction
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryKeys runs a query that selects a single text column, such as storage keys
+func queryKeys(ctx context.Context, q querier, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, translateError(rows.Err())
+}
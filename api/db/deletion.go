@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// queueObjectDeletions records storage objects that must be deleted, as part of the transaction that stops them
+// being referenced
+func queueObjectDeletions(ctx context.Context, tx *sql.Tx, keys []string) error {
+	query := `INSERT INTO object_deletions (key) VALUES ($1) ON CONFLICT DO NOTHING;`
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, query, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// queueUnusedObjectDeletions queues the objects that no photo uses. A photo created from an upload slot keeps the
+// slot's object as its original, so the object outlives the slot and may outlive a photo discarded in a race.
+func queueUnusedObjectDeletions(ctx context.Context, tx *sql.Tx, keys []string) error {
+	var unused []string
+	for _, key := range keys {
+		var used bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM photos WHERE key = $1);`, key).Scan(&used); err != nil {
+			return err
+		}
+
+		if !used {
+			unused = append(unused, key)
+		}
+	}
+
+	return queueObjectDeletions(ctx, tx, unused)
+}
+
+// QueueObjectDeletions records storage objects that couldn't be deleted straight away so that they are retried
+func (db Database) QueueObjectDeletions(ctx context.Context, keys []string) error {
+	ctx, end := db.begin(ctx, "QueueObjectDeletions")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	if err := queueObjectDeletions(ctx, tx, keys); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// GetObjectDeletions returns up to count queued objects, oldest first
+func (db Database) GetObjectDeletions(ctx context.Context, count int) ([]string, error) {
+	ctx, end := db.begin(ctx, "GetObjectDeletions")
+	defer end()
+
+	query := `SELECT key FROM object_deletions ORDER BY created_at, key LIMIT $1;`
+	return queryKeys(ctx, db.Conn, query, count)
+}
+
+// CompleteObjectDeletions removes objects from the queue once they have been deleted from storage
+func (db Database) CompleteObjectDeletions(ctx context.Context, keys []string) error {
+	ctx, end := db.begin(ctx, "CompleteObjectDeletions")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	query := `DELETE FROM object_deletions WHERE key = $1;`
+	for _, key := range keys {
+		if _, err := tx.ExecContext(ctx, query, key); err != nil {
+			return translateError(err)
+		}
+	}
+
+	return translateError(tx.Commit())
+}
@@ -1,30 +1,96 @@
 package db
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 
 	"github.com/yanchenm/photo-sync/models"
 )
 
-func (db Database) GetDetailForPhoto(id string) (models.Detail, error) {
-	detail := models.Detail{}
-	query := `SELECT * FROM details WHERE id = $1;`
+const detailColumns = `id, filetype, height, width, size, taken, camera_make, camera_model, lens, focal_length,
+	aperture, shutter_speed, iso, latitude, longitude, sha256`
 
-	row := db.Conn.QueryRow(query, id)
-	err := row.Scan(&detail.ID, &detail.FileType, &detail.Height, &detail.Width, &detail.Size)
+// detailFields holds scan destinations for a details row. Every column is nullable so that rows from a left join
+// against photos without details can be scanned as well.
+type detailFields struct {
+	id, fileType, cameraMake, cameraModel, lens, shutterSpeed, sha256 sql.NullString
+	height, width, iso                                                sql.NullInt64
+	size, focalLength, aperture, latitude, longitude                  sql.NullFloat64
+	taken                                                             sql.NullTime
+}
+
+func (f *detailFields) dest() []interface{} {
+	return []interface{}{&f.id, &f.fileType, &f.height, &f.width, &f.size, &f.taken, &f.cameraMake, &f.cameraModel,
+		&f.lens, &f.focalLength, &f.aperture, &f.shutterSpeed, &f.iso, &f.latitude, &f.longitude, &f.sha256}
+}
+
+func (f *detailFields) detail() models.Detail {
+	detail := models.Detail{
+		ID:           f.id.String,
+		FileType:     f.fileType.String,
+		Height:       int(f.height.Int64),
+		Width:        int(f.width.Int64),
+		Size:         float32(f.size.Float64),
+		CameraMake:   f.cameraMake.String,
+		CameraModel:  f.cameraModel.String,
+		Lens:         f.lens.String,
+		FocalLength:  f.focalLength.Float64,
+		Aperture:     f.aperture.Float64,
+		ShutterSpeed: f.shutterSpeed.String,
+		ISO:          int(f.iso.Int64),
+		SHA256:       f.sha256.String,
+	}
 
-	switch err {
-	case sql.ErrNoRows:
-		return detail, fmt.Errorf("no matching record")
-	default:
-		return detail, err
+	if f.taken.Valid {
+		taken := f.taken.Time
+		detail.Taken = &taken
 	}
+
+	if f.latitude.Valid && f.longitude.Valid {
+		latitude, longitude := f.latitude.Float64, f.longitude.Float64
+		detail.Latitude = &latitude
+		detail.Longitude = &longitude
+	}
+
+	return detail
+}
+
+func scanDetail(row scanner) (models.Detail, error) {
+	fields := detailFields{}
+	err := row.Scan(fields.dest()...)
+	return fields.detail(), err
 }
 
-func (db Database) AddDetail(detail *models.Detail) error {
-	query := `INSERT INTO details (id, filetype, height, width, size) VALUES ($1, $2, $3, $4, $5)`
-	_, err := db.Conn.Exec(query, detail.ID, detail.FileType, detail.Height, detail.Width, detail.Size)
+func (db Database) GetDetailForPhoto(ctx context.Context, id string) (models.Detail, error) {
+	ctx, end := db.begin(ctx, "GetDetailForPhoto", photoAttribute(id))
+	defer end()
+
+	query := `SELECT ` + detailColumns + ` FROM details WHERE id = $1;`
+	detail, err := scanDetail(db.Conn.QueryRowContext(ctx, query, id))
+
+	return detail, translateError(err)
+}
+
+// insertDetail adds the details of a photo as part of the transaction that adds the photo
+func insertDetail(ctx context.Context, tx *sql.Tx, detail *models.Detail) error {
+	query := `INSERT INTO details (` + detailColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)`
+	_, err := tx.ExecContext(ctx, query, detail.ID, detail.FileType, detail.Height, detail.Width, detail.Size,
+		detail.Taken, nullString(detail.CameraMake), nullString(detail.CameraModel), nullString(detail.Lens),
+		nullFloat(detail.FocalLength), nullFloat(detail.Aperture), nullString(detail.ShutterSpeed),
+		nullInt(detail.ISO), detail.Latitude, detail.Longitude, nullString(detail.SHA256))
 
 	return err
 }
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullFloat(f float64) sql.NullFloat64 {
+	return sql.NullFloat64{Float64: f, Valid: f != 0}
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	ErrNotFound = errors.New("no matching record")
+	ErrConflict = errors.New("record already exists")
+	ErrTimeout  = errors.New("query timed out")
+
+	// ErrCanceled is returned when the caller gave up on a query, such as when a client disconnects
+	ErrCanceled = errors.New("query canceled")
+
+	// ErrDuplicatePhoto is returned when a user adds a photo with the same content as one they already have
+	ErrDuplicatePhoto = fmt.Errorf("%w: photo has already been uploaded", ErrConflict)
+)
+
+// Postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	uniqueViolation = "23505"
+	queryCanceled   = "57014"
+)
+
+// translateError converts driver errors into the errors exported by this package so that callers don't need to
+// know about the underlying database
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("%w: %s", ErrCanceled, err)
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", ErrTimeout, err)
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case uniqueViolation:
+			return fmt.Errorf("%w: %s", ErrConflict, pqErr.Detail)
+		case queryCanceled:
+			return fmt.Errorf("%w: %s", ErrTimeout, pqErr.Message)
+		}
+	}
+
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code() {
+		case sqlite3.SQLITE_CONSTRAINT_UNIQUE, sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY:
+			return fmt.Errorf("%w: %s", ErrConflict, sqliteErr.Error())
+		case sqlite3.SQLITE_INTERRUPT:
+			return fmt.Errorf("%w: %s", ErrTimeout, sqliteErr.Error())
+		}
+	}
+
+	return err
+}
+
+// expectRows converts a statement that affected no rows into ErrNotFound
+func expectRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return translateError(err)
+	}
+
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
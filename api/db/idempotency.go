@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// GetIdempotentPhoto returns the id of the photo that was created by an upload with the same idempotency key, if
+// the key hasn't expired
+func (db Database) GetIdempotentPhoto(ctx context.Context, user, key string, now time.Time) (string, error) {
+	ctx, end := db.begin(ctx, "GetIdempotentPhoto")
+	defer end()
+
+	var photoId string
+	query := `SELECT photo_id FROM idempotency_keys WHERE username = $1 AND key = $2 AND ` +
+		db.Dialect.timeExpr("expires_at") + ` > ` + db.Dialect.timeExpr("$3") + `;`
+	err := db.Conn.QueryRowContext(ctx, query, user, key, now.UTC()).Scan(&photoId)
+
+	return photoId, translateError(err)
+}
+
+// AddIdempotencyKey records the photo created by an upload, so that retrying the upload with the same key returns
+// the photo instead of creating it again. An expired key is replaced, and ErrConflict is returned if the key is
+// already in use.
+func (db Database) AddIdempotencyKey(ctx context.Context, user, key, photoId string, expiresAt time.Time) error {
+	ctx, end := db.begin(ctx, "AddIdempotencyKey", photoAttribute(photoId))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	query := `DELETE FROM idempotency_keys WHERE username = $1 AND key = $2 AND ` +
+		db.Dialect.timeExpr("expires_at") + ` <= ` + db.Dialect.timeExpr("$3") + `;`
+	if _, err := tx.ExecContext(ctx, query, user, key, time.Now().UTC()); err != nil {
+		return translateError(err)
+	}
+
+	query = `INSERT INTO idempotency_keys (username, key, photo_id, expires_at) VALUES ($1, $2, $3, $4);`
+	if _, err := tx.ExecContext(ctx, query, user, key, photoId, expiresAt.UTC()); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// DeleteExpiredIdempotencyKeys forgets idempotency keys that have expired and returns how many there were
+func (db Database) DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int, error) {
+	ctx, end := db.begin(ctx, "DeleteExpiredIdempotencyKeys")
+	defer end()
+
+	query := `DELETE FROM idempotency_keys WHERE ` + db.Dialect.timeExpr("expires_at") + ` < ` +
+		db.Dialect.timeExpr("$1") + `;`
+	res, err := db.Conn.ExecContext(ctx, query, now.UTC())
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return int(n), nil
+}
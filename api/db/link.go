@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+const linkColumns = `l.token, l.username, l.password, l.allow_download, l.expires_at, l.created_at`
+
+func scanLink(row scanner) (models.ShareLink, error) {
+	link := models.ShareLink{}
+	var password sql.NullString
+	var expiresAt sql.NullTime
+
+	err := row.Scan(&link.Token, &link.User, &password, &link.AllowDownload, &expiresAt, &link.CreatedAt)
+	link.Password = password.String
+	if expiresAt.Valid {
+		link.ExpiresAt = &expiresAt.Time
+	}
+
+	link.Photos = []string{}
+	return link, err
+}
+
+func (db Database) AddShareLink(ctx context.Context, link *models.ShareLink) error {
+	ctx, end := db.begin(ctx, "AddShareLink")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	var createdAt string
+	query := `INSERT INTO share_links (token, username, password, allow_download, expires_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING created_at;`
+	var expiresAt sql.NullTime
+	if link.ExpiresAt != nil {
+		expiresAt = sql.NullTime{Time: link.ExpiresAt.UTC(), Valid: true}
+	}
+
+	err = tx.QueryRowContext(ctx, query, link.Token, link.User, nullString(link.Password), link.AllowDownload, expiresAt).
+		Scan(&createdAt)
+	if err != nil {
+		return translateError(err)
+	}
+
+	insert := `INSERT INTO share_link_photos (token, photo_id, position) VALUES ($1, $2, $3);`
+	for i, photoId := range link.Photos {
+		if _, err := tx.ExecContext(ctx, insert, link.Token, photoId, i); err != nil {
+			return translateError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return translateError(err)
+	}
+
+	link.CreatedAt = createdAt
+	return nil
+}
+
+func (db Database) GetShareLink(ctx context.Context, token string) (models.ShareLink, error) {
+	ctx, end := db.begin(ctx, "GetShareLink")
+	defer end()
+
+	query := `SELECT ` + linkColumns + ` FROM share_links l WHERE l.token = $1;`
+	link, err := scanLink(db.Conn.QueryRowContext(ctx, query, token))
+
+	if err != nil {
+		return link, translateError(err)
+	}
+
+	query = `SELECT photo_id FROM share_link_photos WHERE token = $1 ORDER BY position;`
+	rows, err := db.Conn.QueryContext(ctx, query, token)
+	if err != nil {
+		return link, translateError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var photoId string
+		if err := rows.Scan(&photoId); err != nil {
+			return link, translateError(err)
+		}
+
+		link.Photos = append(link.Photos, photoId)
+	}
+
+	return link, translateError(rows.Err())
+}
+
+// GetShareLinks returns the links created by user that haven't expired yet
+func (db Database) GetShareLinks(ctx context.Context, user models.User) ([]models.ShareLink, error) {
+	ctx, end := db.begin(ctx, "GetShareLinks")
+	defer end()
+
+	links := []models.ShareLink{}
+	query := `SELECT ` + linkColumns + ` FROM share_links l WHERE l.username = $1 ORDER BY l.created_at DESC;`
+
+	rows, err := db.Conn.QueryContext(ctx, query, user.Email)
+	if err != nil {
+		return links, translateError(err)
+	}
+
+	defer rows.Close()
+
+	index := make(map[string]int)
+	for rows.Next() {
+		link, err := scanLink(rows)
+		if err != nil {
+			return links, translateError(err)
+		}
+
+		if link.Expired() {
+			continue
+		}
+
+		index[link.Token] = len(links)
+		links = append(links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return links, translateError(err)
+	}
+
+	// Load the photos of every link at once rather than per link
+	query = `SELECT lp.token, lp.photo_id FROM share_link_photos lp JOIN share_links l ON l.token = lp.token
+		WHERE l.username = $1 ORDER BY lp.token, lp.position;`
+
+	photoRows, err := db.Conn.QueryContext(ctx, query, user.Email)
+	if err != nil {
+		return links, translateError(err)
+	}
+
+	defer photoRows.Close()
+
+	for photoRows.Next() {
+		var token, photoId string
+		if err := photoRows.Scan(&token, &photoId); err != nil {
+			return links, translateError(err)
+		}
+
+		if i, ok := index[token]; ok {
+			links[i].Photos = append(links[i].Photos, photoId)
+		}
+	}
+
+	return links, translateError(photoRows.Err())
+}
+
+func (db Database) GetShareLinkPhotos(ctx context.Context, token string) (*models.PhotoList, error) {
+	ctx, end := db.begin(ctx, "GetShareLinkPhotos")
+	defer end()
+
+	res := &models.PhotoList{}
+	query := photoSelect + ` FROM photos p LEFT JOIN details d ON d.id = p.id
+		JOIN share_link_photos lp ON lp.photo_id = p.id WHERE lp.token = $1 ORDER BY lp.position;`
+
+	rows, err := db.Conn.QueryContext(ctx, query, token)
+	if err != nil {
+		return res, translateError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		photo, err := scanPhoto(rows)
+		if err != nil {
+			return res, translateError(err)
+		}
+
+		res.Photos = append(res.Photos, photo)
+	}
+
+	return res, translateError(rows.Err())
+}
+
+func (db Database) DeleteShareLink(ctx context.Context, token string) error {
+	ctx, end := db.begin(ctx, "DeleteShareLink")
+	defer end()
+
+	query := `DELETE FROM share_links WHERE token = $1;`
+	res, err := db.Conn.ExecContext(ctx, query, token)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return expectRows(res)
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Migrations follow the Flyway naming scheme: V<version>__<description>.sql applies a version and
+// U<version>__<description>.sql undoes it. Each dialect has its own directory of migrations with matching versions.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^([VU])(\d+)__(.+)\.sql$`)
+
+// Arbitrary key shared by every instance so that only one of them migrates at a time
+const migrationLockKey = 0x70686f746f73796e
+
+// How long releasing the migration lock can take, since it happens even after the migration's context is done
+const migrationUnlockTimeout = 10 * time.Second
+
+type Migration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+type MigrationStatus struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Applied     bool   `json:"applied"`
+	AppliedAt   string `json:"applied_at,omitempty"`
+}
+
+// Migrations returns the embedded migrations for dialect in version order
+func Migrations(dialect Dialect) ([]Migration, error) {
+	dir := "migrations/" + string(dialect)
+
+	files, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, file := range files {
+		match := migrationName.FindStringSubmatch(file.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", file.Name())
+		}
+
+		version, _ := strconv.Atoi(match[2])
+		contents, err := migrationFiles.ReadFile(dir + "/" + file.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Description: match[3]}
+			byVersion[version] = migration
+		}
+
+		if match[1] == "V" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	var migrations []Migration
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d has no V file", migration.Version)
+		}
+
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a single connection while holding an advisory lock so that concurrent instances
+// starting up don't try to apply the same migrations. SQLite databases belong to a single process and need no lock.
+func (db Database) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if db.Dialect == Postgres {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrationLockKey); err != nil {
+			return err
+		}
+
+		defer unlockMigrations(conn)
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version     INT PRIMARY KEY,
+    description TEXT NOT NULL,
+    applied_at  TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// unlockMigrations releases the migration lock even if the migration was cancelled. The lock belongs to the session,
+// so if it can't be released the connection is thrown away rather than going back to the pool still holding it.
+func unlockMigrations(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationUnlockTimeout)
+	defer cancel()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, migrationLockKey); err != nil {
+		log.WithError(err).Error("failed to release migration lock, closing the connection")
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+	applied := make(map[int]string)
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations;`)
+	if err != nil {
+		return applied, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return applied, err
+		}
+
+		applied[version] = appliedAt
+	}
+
+	return applied, rows.Err()
+}
+
+// runMigration executes a migration script and records the change in schema_migrations in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MigrateUp applies every pending migration and returns how many were applied
+func (db Database) MigrateUp(ctx context.Context) (int, error) {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+
+			record := `INSERT INTO schema_migrations (version, description) VALUES ($1, $2);`
+			err := runMigration(ctx, conn, migration.Up, record, migration.Version, migration.Description)
+			if err != nil {
+				return fmt.Errorf("migration %d failed: %w", migration.Version, err)
+			}
+
+			log.Infof("applied migration %d %s", migration.Version, migration.Description)
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// MigrateDown undoes the most recently applied migrations, up to steps of them, and returns how many were undone
+func (db Database) MigrateDown(ctx context.Context, steps int) (int, error) {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			migration := migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d can't be undone", migration.Version)
+			}
+
+			record := `DELETE FROM schema_migrations WHERE version = $1;`
+			if err := runMigration(ctx, conn, migration.Down, record, migration.Version); err != nil {
+				return fmt.Errorf("undoing migration %d failed: %w", migration.Version, err)
+			}
+
+			log.Infof("undid migration %d %s", migration.Version, migration.Description)
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+func (db Database) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	err = db.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			appliedAt, ok := applied[migration.Version]
+			status = append(status, MigrationStatus{
+				Version:     migration.Version,
+				Description: migration.Description,
+				Applied:     ok,
+				AppliedAt:   appliedAt,
+			})
+		}
+
+		return nil
+	})
+
+	return status, err
+}
+
+// LatestSchemaVersion returns the version of the newest migration bundled with this build
+func (db Database) LatestSchemaVersion() (int, error) {
+	migrations, err := Migrations(db.Dialect)
+	if err != nil || len(migrations) == 0 {
+		return 0, err
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 if none have been applied
+func (db Database) SchemaVersion(ctx context.Context) (int, error) {
+	ctx, end := db.begin(ctx, "SchemaVersion")
+	defer end()
+
+	var version sql.NullInt64
+
+	err := db.Conn.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_migrations;`).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
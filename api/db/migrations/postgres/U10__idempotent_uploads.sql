@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS Idempotency_Keys;
+DROP TABLE IF EXISTS Photo_Hashes;
+ALTER TABLE Details
+    DROP COLUMN IF EXISTS sha256;
@@ -0,0 +1,11 @@
+ALTER TABLE Details
+    DROP COLUMN IF EXISTS taken,
+    DROP COLUMN IF EXISTS camera_make,
+    DROP COLUMN IF EXISTS camera_model,
+    DROP COLUMN IF EXISTS lens,
+    DROP COLUMN IF EXISTS focal_length,
+    DROP COLUMN IF EXISTS aperture,
+    DROP COLUMN IF EXISTS shutter_speed,
+    DROP COLUMN IF EXISTS iso,
+    DROP COLUMN IF EXISTS latitude,
+    DROP COLUMN IF EXISTS longitude;
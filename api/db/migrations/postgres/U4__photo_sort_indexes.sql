@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS photos_username_uploaded_at_idx;
+DROP INDEX IF EXISTS details_taken_idx;
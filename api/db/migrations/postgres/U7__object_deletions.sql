@@ -0,0 +1 @@
+DROP TABLE IF EXISTS Object_Deletions;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS photos_key_idx;
+DROP TABLE IF EXISTS Upload_Slots;
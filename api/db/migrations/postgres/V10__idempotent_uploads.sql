@@ -0,0 +1,24 @@
+ALTER TABLE Details
+    ADD COLUMN IF NOT EXISTS sha256 CHAR(64);
+
+CREATE TABLE IF NOT EXISTS Photo_Hashes
+(
+    username TEXT     NOT NULL REFERENCES Users (email) ON DELETE CASCADE,
+    sha256   CHAR(64) NOT NULL,
+    photo_id CHAR(27) NOT NULL REFERENCES Photos (id) ON DELETE CASCADE,
+    PRIMARY KEY (username, sha256)
+);
+
+CREATE INDEX IF NOT EXISTS photo_hashes_photo_id_idx ON Photo_Hashes (photo_id);
+
+CREATE TABLE IF NOT EXISTS Idempotency_Keys
+(
+    username   TEXT REFERENCES Users (email) ON DELETE CASCADE,
+    key        TEXT     NOT NULL,
+    photo_id   CHAR(27) NOT NULL REFERENCES Photos (id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (username, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON Idempotency_Keys (expires_at);
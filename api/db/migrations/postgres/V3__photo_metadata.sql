@@ -0,0 +1,11 @@
+ALTER TABLE Details
+    ADD COLUMN IF NOT EXISTS taken         TIMESTAMP,
+    ADD COLUMN IF NOT EXISTS camera_make   TEXT,
+    ADD COLUMN IF NOT EXISTS camera_model  TEXT,
+    ADD COLUMN IF NOT EXISTS lens          TEXT,
+    ADD COLUMN IF NOT EXISTS focal_length  FLOAT,
+    ADD COLUMN IF NOT EXISTS aperture      FLOAT,
+    ADD COLUMN IF NOT EXISTS shutter_speed TEXT,
+    ADD COLUMN IF NOT EXISTS iso           INT,
+    ADD COLUMN IF NOT EXISTS latitude      FLOAT,
+    ADD COLUMN IF NOT EXISTS longitude     FLOAT;
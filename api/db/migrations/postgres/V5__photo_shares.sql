@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS Photo_Shares
+(
+    photo_id   CHAR(27) REFERENCES Photos (id) ON DELETE CASCADE,
+    email      TEXT REFERENCES Users (email) ON DELETE CASCADE,
+    permission TEXT NOT NULL CHECK (permission IN ('view', 'download')),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (photo_id, email)
+);
+
+CREATE INDEX IF NOT EXISTS photo_shares_email_idx ON Photo_Shares (email, created_at);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS Share_Links
+(
+    token          TEXT PRIMARY KEY,
+    username       TEXT REFERENCES Users (email) ON DELETE CASCADE,
+    password       VARCHAR(60),
+    allow_download BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at     TIMESTAMPTZ,
+    created_at     TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS Share_Link_Photos
+(
+    token    TEXT REFERENCES Share_Links (token) ON DELETE CASCADE,
+    photo_id CHAR(27) REFERENCES Photos (id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    PRIMARY KEY (token, photo_id)
+);
+
+CREATE INDEX IF NOT EXISTS share_links_username_idx ON Share_Links (username);
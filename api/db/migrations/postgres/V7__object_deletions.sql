@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS Object_Deletions
+(
+    key        TEXT PRIMARY KEY,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS Idempotency_Keys;
+DROP TABLE IF EXISTS Photo_Hashes;
+ALTER TABLE Details DROP COLUMN sha256;
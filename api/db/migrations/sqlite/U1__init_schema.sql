@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS Auth;
+DROP TABLE IF EXISTS Details;
+DROP TABLE IF EXISTS Photos;
+DROP TABLE IF EXISTS Users;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS Album_Photos;
+DROP TABLE IF EXISTS Albums;
@@ -0,0 +1,10 @@
+ALTER TABLE Details DROP COLUMN taken;
+ALTER TABLE Details DROP COLUMN camera_make;
+ALTER TABLE Details DROP COLUMN camera_model;
+ALTER TABLE Details DROP COLUMN lens;
+ALTER TABLE Details DROP COLUMN focal_length;
+ALTER TABLE Details DROP COLUMN aperture;
+ALTER TABLE Details DROP COLUMN shutter_speed;
+ALTER TABLE Details DROP COLUMN iso;
+ALTER TABLE Details DROP COLUMN latitude;
+ALTER TABLE Details DROP COLUMN longitude;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS Share_Link_Photos;
+DROP TABLE IF EXISTS Share_Links;
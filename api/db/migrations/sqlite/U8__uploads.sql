@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS Upload_Chunks;
+DROP TABLE IF EXISTS Uploads;
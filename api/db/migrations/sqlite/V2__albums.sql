@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS Albums
+(
+    id         CHAR(27) PRIMARY KEY,
+    username   TEXT REFERENCES Users (email) ON DELETE CASCADE,
+    name       TEXT NOT NULL,
+    cover      CHAR(27) REFERENCES Photos (id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS Album_Photos
+(
+    album_id CHAR(27) REFERENCES Albums (id) ON DELETE CASCADE,
+    photo_id CHAR(27) REFERENCES Photos (id) ON DELETE CASCADE,
+    position INT NOT NULL,
+    added_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (album_id, photo_id)
+);
+
+CREATE INDEX IF NOT EXISTS album_photos_position_idx ON Album_Photos (album_id, position);
@@ -0,0 +1,10 @@
+ALTER TABLE Details ADD COLUMN taken TIMESTAMP;
+ALTER TABLE Details ADD COLUMN camera_make TEXT;
+ALTER TABLE Details ADD COLUMN camera_model TEXT;
+ALTER TABLE Details ADD COLUMN lens TEXT;
+ALTER TABLE Details ADD COLUMN focal_length FLOAT;
+ALTER TABLE Details ADD COLUMN aperture FLOAT;
+ALTER TABLE Details ADD COLUMN shutter_speed TEXT;
+ALTER TABLE Details ADD COLUMN iso INT;
+ALTER TABLE Details ADD COLUMN latitude FLOAT;
+ALTER TABLE Details ADD COLUMN longitude FLOAT;
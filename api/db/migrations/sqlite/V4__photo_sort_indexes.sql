@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS photos_username_uploaded_at_idx ON Photos (username, uploaded_at);
+CREATE INDEX IF NOT EXISTS details_taken_idx ON Details (taken);
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS Uploads
+(
+    id         CHAR(27) PRIMARY KEY,
+    username   TEXT REFERENCES Users (email) ON DELETE CASCADE,
+    filename   TEXT   NOT NULL,
+    length     BIGINT NOT NULL,
+    received   BIGINT NOT NULL DEFAULT 0,
+    photo_id   CHAR(27) REFERENCES Photos (id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS Upload_Chunks
+(
+    key       TEXT PRIMARY KEY,
+    upload_id CHAR(27) REFERENCES Uploads (id) ON DELETE CASCADE,
+    start     BIGINT NOT NULL,
+    size      BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON Uploads (expires_at);
+CREATE INDEX IF NOT EXISTS upload_chunks_upload_id_idx ON Upload_Chunks (upload_id, start);
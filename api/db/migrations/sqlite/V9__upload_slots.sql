@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS Upload_Slots
+(
+    id           CHAR(27) PRIMARY KEY,
+    username     TEXT REFERENCES Users (email) ON DELETE CASCADE,
+    filename     TEXT   NOT NULL,
+    key          TEXT   NOT NULL UNIQUE,
+    content_type TEXT   NOT NULL,
+    size         BIGINT NOT NULL,
+    photo_id     CHAR(27) REFERENCES Photos (id) ON DELETE CASCADE,
+    expires_at   TIMESTAMP NOT NULL,
+    created_at   TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS upload_slots_expires_at_idx ON Upload_Slots (expires_at);
+
+CREATE INDEX IF NOT EXISTS photos_key_idx ON Photos (key);
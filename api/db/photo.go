@@ -1,86 +1,471 @@
 package db
 
 import (
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/yanchenm/photo-sync/models"
 )
 
-func (db Database) GetPhotos(user models.User, start, count int) (*models.PhotoList, error) {
+const (
+	SortTaken    = "taken"
+	SortUploaded = "uploaded"
+	SortFilename = "filename"
+	SortSize     = "size"
+)
+
+// Photos without a capture time are placed on the timeline by when they were uploaded
+var photoSortColumns = map[string]string{
+	SortTaken:    "COALESCE(d.taken, p.uploaded_at)",
+	SortUploaded: "p.uploaded_at",
+	SortFilename: "p.filename",
+	SortSize:     "COALESCE(d.size, 0)",
+}
+
+func ValidPhotoSort(sort string) bool {
+	_, ok := photoSortColumns[sort]
+	return ok
+}
+
+func isTimeSort(sort string) bool {
+	return sort != SortFilename && sort != SortSize
+}
+
+// PhotoFilter controls the order and range of photos returned by GetPhotos. Zero times are treated as unbounded.
+type PhotoFilter struct {
+	Sort         string
+	Ascending    bool
+	TakenFrom    time.Time
+	TakenTo      time.Time
+	UploadedFrom time.Time
+	UploadedTo   time.Time
+}
+
+// where builds the conditions shared by GetPhotos and GetNumPhotos so that counts match the listing
+func (f PhotoFilter) where(dialect Dialect, user models.User) (string, []interface{}) {
+	conditions := []string{"p.username = $1"}
+	args := []interface{}{user.Email}
+
+	add := func(column, comparison string, value time.Time) {
+		if value.IsZero() {
+			return
+		}
+
+		args = append(args, value.UTC())
+		placeholder := dialect.timeExpr(fmt.Sprintf("$%d", len(args)))
+		conditions = append(conditions, dialect.timeExpr(column)+" "+comparison+" "+placeholder)
+	}
+
+	add("d.taken", ">=", f.TakenFrom)
+	add("d.taken", "<", f.TakenTo)
+	add("p.uploaded_at", ">=", f.UploadedFrom)
+	add("p.uploaded_at", "<", f.UploadedTo)
+
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (f PhotoFilter) sortColumn(dialect Dialect) string {
+	column, ok := photoSortColumns[f.Sort]
+	if !ok {
+		column = photoSortColumns[SortUploaded]
+	}
+
+	if isTimeSort(f.Sort) {
+		return dialect.timeExpr(column)
+	}
+
+	return column
+}
+
+// orderBy sorts rows in the order of the filter or, if reverse is set, in the opposite order
+func (f PhotoFilter) orderBy(dialect Dialect, reverse bool) string {
+	direction := "DESC"
+	if f.Ascending != reverse {
+		direction = "ASC"
+	}
+
+	// Break ties on id so that pages are stable
+	return fmt.Sprintf(" ORDER BY %s %s, p.id %s", f.sortColumn(dialect), direction, direction)
+}
+
+// photoSelect selects photos together with their details so that listings don't need a query per photo
+const photoSelect = `SELECT p.id, p.username, p.filename, p.key, p.thumbnail, p.uploaded_at, d.id, d.filetype, d.height,
+	d.width, d.size, d.taken, d.camera_make, d.camera_model, d.lens, d.focal_length, d.aperture, d.shutter_speed, d.iso,
+	d.latitude, d.longitude, d.sha256`
+
+// scanPhoto scans a row selected by photoSelect, followed by any extra columns
+func scanPhoto(row scanner, extra ...interface{}) (models.Photo, error) {
+	photo := models.Photo{}
+	details := detailFields{}
+
+	dest := []interface{}{&photo.ID, &photo.User, &photo.Filename, &photo.Key, &photo.Thumbnail, &photo.UploadedAt}
+	dest = append(dest, details.dest()...)
+	dest = append(dest, extra...)
+
+	err := row.Scan(dest...)
+	photo.Details = details.detail()
+
+	return photo, err
+}
+
+func (db Database) GetPhotos(ctx context.Context, user models.User, filter PhotoFilter, start, count int) (*models.PhotoList, error) {
+	ctx, end := db.begin(ctx, "GetPhotos")
+	defer end()
+
 	res := &models.PhotoList{}
-	query := `SELECT * FROM photos WHERE username = $1 ORDER BY uploaded_at DESC LIMIT $2 OFFSET $3;`
+	where, args := filter.where(db.Dialect, user)
+
+	query := photoSelect + ` FROM photos p LEFT JOIN details d ON d.id = p.id` + where + filter.orderBy(db.Dialect, false) +
+		fmt.Sprintf(" LIMIT $%d OFFSET $%d;", len(args)+1, len(args)+2)
+	args = append(args, count, start)
 
-	rows, err := db.Conn.Query(query, user.Email, count, start)
+	rows, err := db.Conn.QueryContext(ctx, query, args...)
 	if err != nil {
-		return res, err
+		return res, translateError(err)
 	}
 
 	defer rows.Close()
 
 	for rows.Next() {
-		var photo models.Photo
-		err := rows.Scan(&photo.ID, &photo.User, &photo.Filename, &photo.Key, &photo.Thumbnail, &photo.UploadedAt)
+		photo, err := scanPhoto(rows)
 		if err != nil {
-			return res, nil
+			return res, translateError(err)
 		}
 
 		res.Photos = append(res.Photos, photo)
 	}
 
-	return res, nil
+	return res, translateError(rows.Err())
+}
+
+// PhotoCursor marks a position in a photo listing by the sort value and id of a photo
+type PhotoCursor struct {
+	Value string
+	ID    string
 }
 
-func (db Database) GetNumPhotos(user models.User) (int, error) {
+type PhotoPage struct {
+	Photos  models.PhotoList
+	First   PhotoCursor
+	Last    PhotoCursor
+	HasNext bool
+	HasPrev bool
+}
+
+// GetPhotosByCursor returns the page of count photos that follows after, or precedes before if it is set instead.
+// If neither cursor is set, the first page is returned.
+func (db Database) GetPhotosByCursor(ctx context.Context, user models.User, filter PhotoFilter, after, before *PhotoCursor, count int) (*PhotoPage, error) {
+	ctx, end := db.begin(ctx, "GetPhotosByCursor")
+	defer end()
+
+	page := &PhotoPage{}
+	where, args := filter.where(db.Dialect, user)
+
+	cursor, reverse := after, false
+	if before != nil {
+		cursor, reverse = before, true
+	}
+
+	if cursor != nil {
+		value, err := filter.parseSortValue(cursor.Value)
+		if err != nil {
+			return page, err
+		}
+
+		placeholder := fmt.Sprintf("$%d", len(args)+1)
+		if isTimeSort(filter.Sort) {
+			placeholder = db.Dialect.timeExpr(placeholder)
+		}
+
+		// Rows past the cursor are those further along in the direction we are reading
+		comparison := "<"
+		if filter.Ascending != reverse {
+			comparison = ">"
+		}
+
+		args = append(args, value, cursor.ID)
+		where += fmt.Sprintf(" AND (%s, p.id) %s (%s, $%d)", filter.sortColumn(db.Dialect), comparison, placeholder, len(args))
+	}
+
+	// Fetch one extra row to find out whether there is another page
+	query := photoSelect + `, ` + filter.sortColumn(db.Dialect) + ` FROM photos p LEFT JOIN details d ON d.id = p.id` + where + filter.orderBy(db.Dialect, reverse) +
+		fmt.Sprintf(" LIMIT $%d;", len(args)+1)
+	args = append(args, count+1)
+
+	rows, err := db.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return page, translateError(err)
+	}
+
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value interface{}
+
+		photo, err := scanPhoto(rows, &value)
+		if err != nil {
+			return page, translateError(err)
+		}
+
+		page.Photos.Photos = append(page.Photos.Photos, photo)
+		values = append(values, formatSortValue(value))
+	}
+
+	if err := rows.Err(); err != nil {
+		return page, translateError(err)
+	}
+
+	more := len(page.Photos.Photos) > count
+	if more {
+		page.Photos.Photos = page.Photos.Photos[:count]
+		values = values[:count]
+	}
+
+	if reverse {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			page.Photos.Photos[i], page.Photos.Photos[j] = page.Photos.Photos[j], page.Photos.Photos[i]
+			values[i], values[j] = values[j], values[i]
+		}
+
+		page.HasPrev, page.HasNext = more, true
+	} else {
+		page.HasPrev, page.HasNext = cursor != nil, more
+	}
+
+	if n := len(values); n > 0 {
+		page.First = PhotoCursor{Value: values[0], ID: page.Photos.Photos[0].ID}
+		page.Last = PhotoCursor{Value: values[n-1], ID: page.Photos.Photos[n-1].ID}
+	}
+
+	return page, nil
+}
+
+func formatSortValue(value interface{}) string {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseSortValue converts a cursor value back into a query argument. Timestamps are passed through as text, which
+// both dialects convert in the same way as the values they were read from.
+func (f PhotoFilter) parseSortValue(value string) (interface{}, error) {
+	switch f.Sort {
+	case SortSize:
+		return strconv.ParseFloat(value, 64)
+	default:
+		return value, nil
+	}
+}
+
+func (db Database) GetNumPhotos(ctx context.Context, user models.User, filter PhotoFilter) (int, error) {
+	ctx, end := db.begin(ctx, "GetNumPhotos")
+	defer end()
+
 	var count int
+	where, args := filter.where(db.Dialect, user)
 
-	query := `SELECT COUNT(*) FROM photos WHERE username = $1;`
-	row := db.Conn.QueryRow(query, user.Email)
+	query := `SELECT COUNT(*) FROM photos p LEFT JOIN details d ON d.id = p.id` + where + `;`
+	row := db.Conn.QueryRowContext(ctx, query, args...)
 
 	err := row.Scan(&count)
 	if err != nil {
-		return 0, err
+		return 0, translateError(err)
 	}
 
 	return count, nil
 }
 
-func (db Database) GetPhotoById(id string) (models.Photo, error) {
+func (db Database) GetPhotoById(ctx context.Context, id string) (models.Photo, error) {
+	ctx, end := db.begin(ctx, "GetPhotoById", photoAttribute(id))
+	defer end()
+
 	photo := models.Photo{}
 	query := `SELECT * FROM photos WHERE id = $1;`
 
-	row := db.Conn.QueryRow(query, id)
+	row := db.Conn.QueryRowContext(ctx, query, id)
 	err := row.Scan(&photo.ID, &photo.User, &photo.Filename, &photo.Key, &photo.Thumbnail, &photo.UploadedAt)
 
-	switch err {
-	case sql.ErrNoRows:
-		return photo, fmt.Errorf("no matching record")
-	default:
-		return photo, err
+	return photo, translateError(err)
+}
+
+// GetPhotoOwners looks up the owner of every photo in ids in one query. Photos that don't exist are left out.
+func (db Database) GetPhotoOwners(ctx context.Context, ids []string) (map[string]string, error) {
+	ctx, end := db.begin(ctx, "GetPhotoOwners")
+	defer end()
+
+	owners := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return owners, nil
+	}
+
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+
+	query := `SELECT id, username FROM photos WHERE id IN (` + strings.Join(placeholders, ", ") + `);`
+	rows, err := db.Conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return owners, translateError(err)
 	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, owner string
+		if err := rows.Scan(&id, &owner); err != nil {
+			return owners, translateError(err)
+		}
+
+		owners[id] = owner
+	}
+
+	return owners, translateError(rows.Err())
 }
 
-func (db Database) AddPhoto(photo *models.Photo) error {
+func (db Database) GetPhotoWithDetail(ctx context.Context, id string) (models.Photo, error) {
+	ctx, end := db.begin(ctx, "GetPhotoWithDetail", photoAttribute(id))
+	defer end()
+
+	query := photoSelect + ` FROM photos p LEFT JOIN details d ON d.id = p.id WHERE p.id = $1;`
+	photo, err := scanPhoto(db.Conn.QueryRowContext(ctx, query, id))
+
+	return photo, translateError(err)
+}
+
+// GetPhotoByHash returns a photo belonging to user whose original has the given SHA-256 digest, so that uploading
+// the same file twice can be detected
+func (db Database) GetPhotoByHash(ctx context.Context, user, sha256 string) (models.Photo, error) {
+	ctx, end := db.begin(ctx, "GetPhotoByHash")
+	defer end()
+
+	query := photoSelect + ` FROM photo_hashes h JOIN photos p ON p.id = h.photo_id LEFT JOIN details d ON d.id = p.id
+		WHERE h.username = $1 AND h.sha256 = $2;`
+	photo, err := scanPhoto(db.Conn.QueryRowContext(ctx, query, user, sha256))
+
+	return photo, translateError(err)
+}
+
+// PhotoObjects are the storage objects that belong to a photo
+type PhotoObjects struct {
+	ID        string
+	Key       string
+	Thumbnail string
+}
+
+// GetPhotoObjects returns the storage keys of every photo, for comparing the database with storage
+func (db Database) GetPhotoObjects(ctx context.Context) ([]PhotoObjects, error) {
+	ctx, end := db.begin(ctx, "GetPhotoObjects")
+	defer end()
+
+	query := `SELECT id, key, thumbnail FROM photos ORDER BY id;`
+	rows, err := db.Conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	defer rows.Close()
+
+	var photos []PhotoObjects
+	for rows.Next() {
+		var photo PhotoObjects
+		if err := rows.Scan(&photo.ID, &photo.Key, &photo.Thumbnail); err != nil {
+			return nil, translateError(err)
+		}
+
+		photos = append(photos, photo)
+	}
+
+	return photos, translateError(rows.Err())
+}
+
+// AddPhoto inserts a photo together with its details, so that a photo is never visible without them. The digest
+// of the original is unique per user, and ErrDuplicatePhoto is returned if the user already has a photo with it.
+func (db Database) AddPhoto(ctx context.Context, photo *models.Photo) error {
+	ctx, end := db.begin(ctx, "AddPhoto", photoAttribute(photo.ID))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
 	var uploadedAt string
 
 	query := `INSERT INTO photos (id, username, filename, key, thumbnail) VALUES ($1, $2, $3, $4, $5) RETURNING uploaded_at;`
-	err := db.Conn.QueryRow(query, photo.ID, photo.User, photo.Filename, photo.Key, photo.Thumbnail).Scan(&uploadedAt)
+	err = tx.QueryRowContext(ctx, query, photo.ID, photo.User, photo.Filename, photo.Key, photo.Thumbnail).Scan(&uploadedAt)
 	if err != nil {
-		return err
+		return translateError(err)
+	}
+
+	if err := insertDetail(ctx, tx, &photo.Details); err != nil {
+		return translateError(err)
+	}
+
+	if photo.Details.SHA256 != "" {
+		query := `INSERT INTO photo_hashes (username, sha256, photo_id) VALUES ($1, $2, $3);`
+		_, err := tx.ExecContext(ctx, query, photo.User, photo.Details.SHA256, photo.ID)
+		if err := translateError(err); errors.Is(err, ErrConflict) {
+			return ErrDuplicatePhoto
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return translateError(err)
 	}
 
 	photo.UploadedAt = uploadedAt
 	return nil
 }
 
-func (db Database) DeletePhoto(id string) error {
+// DeletePhoto deletes a photo and queues its objects for deletion from storage in the same transaction, so the
+// objects are never forgotten even if removing them fails
+func (db Database) DeletePhoto(ctx context.Context, photo models.Photo) error {
+	ctx, end := db.begin(ctx, "DeletePhoto", photoAttribute(photo.ID))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
 	query := `DELETE FROM photos WHERE id = $1;`
-	_, err := db.Conn.Exec(query, id)
+	res, err := tx.ExecContext(ctx, query, photo.ID)
+	if err != nil {
+		return translateError(err)
+	}
 
-	switch err {
-	case sql.ErrNoRows:
-		return fmt.Errorf("no matching record")
-	default:
+	if err := expectRows(res); err != nil {
 		return err
 	}
+
+	if err := queueObjectDeletions(ctx, tx, []string{photo.Thumbnail}); err != nil {
+		return translateError(err)
+	}
+
+	if err := queueUnusedObjectDeletions(ctx, tx, []string{photo.Key}); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
 }
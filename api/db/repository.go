@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// Database implements every repository for both Postgres and SQLite. The interfaces let handlers depend on only
+// the storage they need and be tested against any implementation.
+
+type UserRepository interface {
+	GetUserFromEmail(ctx context.Context, email string) (models.User, error)
+	AddUser(ctx context.Context, user *models.User) error
+	DeleteUser(ctx context.Context, email string) error
+}
+
+type PhotoRepository interface {
+	GetPhotos(ctx context.Context, user models.User, filter PhotoFilter, start, count int) (*models.PhotoList, error)
+	GetPhotosByCursor(ctx context.Context, user models.User, filter PhotoFilter, after, before *PhotoCursor, count int) (*PhotoPage, error)
+	GetNumPhotos(ctx context.Context, user models.User, filter PhotoFilter) (int, error)
+	GetPhotoById(ctx context.Context, id string) (models.Photo, error)
+	GetPhotoOwners(ctx context.Context, ids []string) (map[string]string, error)
+	GetPhotoWithDetail(ctx context.Context, id string) (models.Photo, error)
+	GetPhotoByHash(ctx context.Context, user, sha256 string) (models.Photo, error)
+	GetPhotoObjects(ctx context.Context) ([]PhotoObjects, error)
+	AddPhoto(ctx context.Context, photo *models.Photo) error
+	DeletePhoto(ctx context.Context, photo models.Photo) error
+}
+
+type DetailRepository interface {
+	GetDetailForPhoto(ctx context.Context, id string) (models.Detail, error)
+}
+
+type TokenRepository interface {
+	AddToken(ctx context.Context, token models.RefreshToken) error
+	TokenValid(ctx context.Context, token models.RefreshToken) bool
+	DeleteToken(ctx context.Context, token models.RefreshToken) error
+}
+
+type AlbumRepository interface {
+	GetAlbums(ctx context.Context, user models.User) (*models.AlbumList, error)
+	GetAlbumById(ctx context.Context, id string) (models.Album, error)
+	GetAlbumPhotos(ctx context.Context, id string) (*models.PhotoList, error)
+	AddAlbum(ctx context.Context, album *models.Album, photoIds []string) error
+	RenameAlbum(ctx context.Context, id, name string) error
+	DeleteAlbum(ctx context.Context, id string) error
+	AddPhotosToAlbum(ctx context.Context, id string, photoIds []string) error
+	RemovePhotoFromAlbum(ctx context.Context, id, photoId string) error
+	ReorderAlbum(ctx context.Context, id string, photoIds []string) error
+	SetAlbumCover(ctx context.Context, id, photoId string) error
+}
+
+type ShareRepository interface {
+	AddShare(ctx context.Context, share *models.Share) error
+	DeleteShare(ctx context.Context, photoId, email string) error
+	GetSharesForPhoto(ctx context.Context, photoId string) ([]models.Share, error)
+	GetSharePermission(ctx context.Context, photoId, email string) (string, error)
+	GetSharedPhotos(ctx context.Context, user models.User, start, count int) (*models.PhotoList, error)
+}
+
+type LinkRepository interface {
+	AddShareLink(ctx context.Context, link *models.ShareLink) error
+	GetShareLink(ctx context.Context, token string) (models.ShareLink, error)
+	GetShareLinks(ctx context.Context, user models.User) ([]models.ShareLink, error)
+	GetShareLinkPhotos(ctx context.Context, token string) (*models.PhotoList, error)
+	DeleteShareLink(ctx context.Context, token string) error
+}
+
+// ObjectDeletionRepository is a queue of storage objects that are no longer referenced by the database but may
+// not have been deleted from storage yet
+type ObjectDeletionRepository interface {
+	QueueObjectDeletions(ctx context.Context, keys []string) error
+	GetObjectDeletions(ctx context.Context, count int) ([]string, error)
+	CompleteObjectDeletions(ctx context.Context, keys []string) error
+}
+
+// UploadRepository tracks photos that are still being uploaded, either in chunks through the API or straight to
+// storage through an upload slot, along with the objects they have staged in storage
+type UploadRepository interface {
+	AddUpload(ctx context.Context, upload *models.Upload) error
+	GetUpload(ctx context.Context, id string) (models.Upload, error)
+	AddUploadChunk(ctx context.Context, id string, offset int64, key string, size int64, expiresAt time.Time) error
+	GetUploadChunks(ctx context.Context, id string) ([]string, error)
+	GetUploadObjects(ctx context.Context) ([]string, error)
+	CompleteUpload(ctx context.Context, id, photoId string) error
+	DeleteUpload(ctx context.Context, id string) error
+	DeleteExpiredUploads(ctx context.Context, now time.Time) (int, error)
+
+	AddUploadSlot(ctx context.Context, slot *models.UploadSlot) error
+	GetUploadSlot(ctx context.Context, id string) (models.UploadSlot, error)
+	CompleteUploadSlot(ctx context.Context, id, photoId string) error
+	DeleteExpiredUploadSlots(ctx context.Context, now time.Time) (int, error)
+}
+
+// IdempotencyRepository remembers the photos created by uploads that were sent with an idempotency key
+type IdempotencyRepository interface {
+	GetIdempotentPhoto(ctx context.Context, user, key string, now time.Time) (string, error)
+	AddIdempotencyKey(ctx context.Context, user, key, photoId string, expiresAt time.Time) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, now time.Time) (int, error)
+}
+
+// Repository is everything the server needs from the database
+type Repository interface {
+	UserRepository
+	PhotoRepository
+	DetailRepository
+	TokenRepository
+	AlbumRepository
+	ShareRepository
+	LinkRepository
+	ObjectDeletionRepository
+	UploadRepository
+	IdempotencyRepository
+
+	Ping(ctx context.Context) error
+	Stats() sql.DBStats
+	SchemaVersion(ctx context.Context) (int, error)
+	LatestSchemaVersion() (int, error)
+	Close() error
+}
+
+var _ Repository = Database{}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// AddShare grants a user access to a photo, replacing any access they already had
+func (db Database) AddShare(ctx context.Context, share *models.Share) error {
+	ctx, end := db.begin(ctx, "AddShare")
+	defer end()
+
+	var createdAt string
+
+	query := `INSERT INTO photo_shares (photo_id, email, permission) VALUES ($1, $2, $3)
+		ON CONFLICT (photo_id, email) DO UPDATE SET permission = EXCLUDED.permission RETURNING created_at;`
+	err := db.Conn.QueryRowContext(ctx, query, share.PhotoID, share.Email, share.Permission).Scan(&createdAt)
+	if err != nil {
+		return translateError(err)
+	}
+
+	share.CreatedAt = createdAt
+	return nil
+}
+
+func (db Database) DeleteShare(ctx context.Context, photoId, email string) error {
+	ctx, end := db.begin(ctx, "DeleteShare")
+	defer end()
+
+	query := `DELETE FROM photo_shares WHERE photo_id = $1 AND email = $2;`
+	res, err := db.Conn.ExecContext(ctx, query, photoId, email)
+	if err != nil {
+		return translateError(err)
+	}
+
+	return expectRows(res)
+}
+
+func (db Database) GetSharesForPhoto(ctx context.Context, photoId string) ([]models.Share, error) {
+	ctx, end := db.begin(ctx, "GetSharesForPhoto")
+	defer end()
+
+	shares := []models.Share{}
+	query := `SELECT photo_id, email, permission, created_at FROM photo_shares WHERE photo_id = $1 ORDER BY created_at;`
+
+	rows, err := db.Conn.QueryContext(ctx, query, photoId)
+	if err != nil {
+		return shares, translateError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var share models.Share
+		if err := rows.Scan(&share.PhotoID, &share.Email, &share.Permission, &share.CreatedAt); err != nil {
+			return shares, translateError(err)
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares, translateError(rows.Err())
+}
+
+func (db Database) GetSharePermission(ctx context.Context, photoId, email string) (string, error) {
+	ctx, end := db.begin(ctx, "GetSharePermission")
+	defer end()
+
+	var permission string
+	query := `SELECT permission FROM photo_shares WHERE photo_id = $1 AND email = $2;`
+
+	err := db.Conn.QueryRowContext(ctx, query, photoId, email).Scan(&permission)
+
+	return permission, translateError(err)
+}
+
+// GetSharedPhotos returns photos other users have shared with user, most recently shared first
+func (db Database) GetSharedPhotos(ctx context.Context, user models.User, start, count int) (*models.PhotoList, error) {
+	ctx, end := db.begin(ctx, "GetSharedPhotos")
+	defer end()
+
+	res := &models.PhotoList{}
+	query := photoSelect + `, s.permission FROM photos p LEFT JOIN details d ON d.id = p.id
+		JOIN photo_shares s ON s.photo_id = p.id WHERE s.email = $1
+		ORDER BY s.created_at DESC, p.id DESC LIMIT $2 OFFSET $3;`
+
+	rows, err := db.Conn.QueryContext(ctx, query, user.Email, count, start)
+	if err != nil {
+		return res, translateError(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var permission string
+
+		photo, err := scanPhoto(rows, &permission)
+		if err != nil {
+			return res, translateError(err)
+		}
+
+		photo.Permission = permission
+		res.Photos = append(res.Photos, photo)
+	}
+
+	return res, translateError(rows.Err())
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+const uploadColumns = `id, username, filename, length, received, photo_id, expires_at, created_at`
+
+func uploadAttribute(id string) attribute.KeyValue {
+	return attribute.String("upload_id", id)
+}
+
+func scanUpload(row scanner) (models.Upload, error) {
+	upload := models.Upload{}
+	var photoId sql.NullString
+
+	err := row.Scan(&upload.ID, &upload.User, &upload.Filename, &upload.Length, &upload.Offset, &photoId,
+		&upload.ExpiresAt, &upload.CreatedAt)
+	upload.PhotoID = photoId.String
+
+	return upload, err
+}
+
+func (db Database) AddUpload(ctx context.Context, upload *models.Upload) error {
+	ctx, end := db.begin(ctx, "AddUpload", uploadAttribute(upload.ID))
+	defer end()
+
+	var createdAt string
+	query := `INSERT INTO uploads (id, username, filename, length, expires_at) VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at;`
+	err := db.Conn.QueryRowContext(ctx, query, upload.ID, upload.User, upload.Filename, upload.Length,
+		upload.ExpiresAt.UTC()).Scan(&createdAt)
+	if err != nil {
+		return translateError(err)
+	}
+
+	upload.CreatedAt = createdAt
+	return nil
+}
+
+func (db Database) GetUpload(ctx context.Context, id string) (models.Upload, error) {
+	ctx, end := db.begin(ctx, "GetUpload", uploadAttribute(id))
+	defer end()
+
+	query := `SELECT ` + uploadColumns + ` FROM uploads WHERE id = $1;`
+	upload, err := scanUpload(db.Conn.QueryRowContext(ctx, query, id))
+
+	return upload, translateError(err)
+}
+
+// AddUploadChunk records a chunk that has been written to storage and moves the upload's offset past it. The
+// chunk must start at the current offset, otherwise ErrConflict is returned, so that two requests racing to write
+// the same part of an upload can't both succeed.
+func (db Database) AddUploadChunk(ctx context.Context, id string, offset int64, key string, size int64, expiresAt time.Time) error {
+	ctx, end := db.begin(ctx, "AddUploadChunk", uploadAttribute(id))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	query := `UPDATE uploads SET received = received + $3, expires_at = $4
+		WHERE id = $1 AND received = $2 AND received + $3 <= length AND photo_id IS NULL;`
+	res, err := tx.ExecContext(ctx, query, id, offset, size, expiresAt.UTC())
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := expectRows(res); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return ErrConflict
+		}
+
+		return translateError(err)
+	}
+
+	query = `INSERT INTO upload_chunks (key, upload_id, start, size) VALUES ($1, $2, $3, $4);`
+	if _, err := tx.ExecContext(ctx, query, key, id, offset, size); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// GetUploadChunks returns the storage keys of an upload's chunks in the order they make up the file
+func (db Database) GetUploadChunks(ctx context.Context, id string) ([]string, error) {
+	ctx, end := db.begin(ctx, "GetUploadChunks", uploadAttribute(id))
+	defer end()
+
+	query := `SELECT key FROM upload_chunks WHERE upload_id = $1 ORDER BY start;`
+	return queryKeys(ctx, db.Conn, query, id)
+}
+
+// GetUploadObjects returns the storage keys of every chunk of every unfinished upload and of every upload slot that
+// hasn't been finalized, for comparing the database with storage
+func (db Database) GetUploadObjects(ctx context.Context) ([]string, error) {
+	ctx, end := db.begin(ctx, "GetUploadObjects")
+	defer end()
+
+	query := `SELECT key FROM upload_chunks UNION SELECT key FROM upload_slots WHERE photo_id IS NULL ORDER BY key;`
+	return queryKeys(ctx, db.Conn, query)
+}
+
+// CompleteUpload links an upload to the photo that was created from it and queues its chunks for deletion from
+// storage in the same transaction
+func (db Database) CompleteUpload(ctx context.Context, id, photoId string) error {
+	ctx, end := db.begin(ctx, "CompleteUpload", uploadAttribute(id))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	query := `UPDATE uploads SET photo_id = $2 WHERE id = $1 AND photo_id IS NULL;`
+	res, err := tx.ExecContext(ctx, query, id, photoId)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := expectRows(res); err != nil {
+		return err
+	}
+
+	if err := discardUploadChunks(ctx, tx, `upload_id = $1`, id); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// DeleteUpload deletes an upload and queues its chunks for deletion from storage in the same transaction
+func (db Database) DeleteUpload(ctx context.Context, id string) error {
+	ctx, end := db.begin(ctx, "DeleteUpload", uploadAttribute(id))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	if err := discardUploadChunks(ctx, tx, `upload_id = $1`, id); err != nil {
+		return translateError(err)
+	}
+
+	query := `DELETE FROM uploads WHERE id = $1;`
+	res, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := expectRows(res); err != nil {
+		return err
+	}
+
+	return translateError(tx.Commit())
+}
+
+// DeleteExpiredUploads deletes every upload that expired before now, queueing their chunks for deletion from
+// storage, and returns how many were deleted
+func (db Database) DeleteExpiredUploads(ctx context.Context, now time.Time) (int, error) {
+	ctx, end := db.begin(ctx, "DeleteExpiredUploads")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	expired := db.Dialect.timeExpr("expires_at") + " < " + db.Dialect.timeExpr("$1")
+	condition := `upload_id IN (SELECT id FROM uploads WHERE ` + expired + `)`
+	if err := discardUploadChunks(ctx, tx, condition, now.UTC()); err != nil {
+		return 0, translateError(err)
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM uploads WHERE `+expired+`;`, now.UTC())
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return int(n), translateError(tx.Commit())
+}
+
+// discardUploadChunks deletes the chunks matching condition and queues their objects for deletion from storage
+func discardUploadChunks(ctx context.Context, tx *sql.Tx, condition string, args ...interface{}) error {
+	keys, err := queryKeys(ctx, tx, `SELECT key FROM upload_chunks WHERE `+condition+`;`, args...)
+	if err != nil {
+		return err
+	}
+
+	if err := queueObjectDeletions(ctx, tx, keys); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM upload_chunks WHERE `+condition+`;`, args...)
+	return err
+}
+
+const uploadSlotColumns = `id, username, filename, key, content_type, size, photo_id, expires_at, created_at`
+
+func scanUploadSlot(row scanner) (models.UploadSlot, error) {
+	slot := models.UploadSlot{}
+	var photoId sql.NullString
+
+	err := row.Scan(&slot.ID, &slot.User, &slot.Filename, &slot.Key, &slot.ContentType, &slot.Size, &photoId,
+		&slot.ExpiresAt, &slot.CreatedAt)
+	slot.PhotoID = photoId.String
+
+	return slot, err
+}
+
+func (db Database) AddUploadSlot(ctx context.Context, slot *models.UploadSlot) error {
+	ctx, end := db.begin(ctx, "AddUploadSlot", uploadAttribute(slot.ID))
+	defer end()
+
+	var createdAt string
+	query := `INSERT INTO upload_slots (id, username, filename, key, content_type, size, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING created_at;`
+	err := db.Conn.QueryRowContext(ctx, query, slot.ID, slot.User, slot.Filename, slot.Key, slot.ContentType,
+		slot.Size, slot.ExpiresAt.UTC()).Scan(&createdAt)
+	if err != nil {
+		return translateError(err)
+	}
+
+	slot.CreatedAt = createdAt
+	return nil
+}
+
+func (db Database) GetUploadSlot(ctx context.Context, id string) (models.UploadSlot, error) {
+	ctx, end := db.begin(ctx, "GetUploadSlot", uploadAttribute(id))
+	defer end()
+
+	query := `SELECT ` + uploadSlotColumns + ` FROM upload_slots WHERE id = $1;`
+	slot, err := scanUploadSlot(db.Conn.QueryRowContext(ctx, query, id))
+
+	return slot, translateError(err)
+}
+
+// CompleteUploadSlot links a slot to the photo that was created from it. The uploaded object is queued for
+// deletion from storage in the same transaction, unless a photo keeps it as its original. ErrConflict is returned
+// if the slot was already finalized.
+func (db Database) CompleteUploadSlot(ctx context.Context, id, photoId string) error {
+	ctx, end := db.begin(ctx, "CompleteUploadSlot", uploadAttribute(id))
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	var key string
+	query := `UPDATE upload_slots SET photo_id = $2 WHERE id = $1 AND photo_id IS NULL RETURNING key;`
+	if err := tx.QueryRowContext(ctx, query, id, photoId).Scan(&key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrConflict
+		}
+
+		return translateError(err)
+	}
+
+	if err := queueUnusedObjectDeletions(ctx, tx, []string{key}); err != nil {
+		return translateError(err)
+	}
+
+	return translateError(tx.Commit())
+}
+
+// DeleteExpiredUploadSlots deletes every upload slot that expired before now, queueing the objects of those that
+// were never finalized for deletion from storage unless a photo uses them, and returns how many were deleted
+func (db Database) DeleteExpiredUploadSlots(ctx context.Context, now time.Time) (int, error) {
+	ctx, end := db.begin(ctx, "DeleteExpiredUploadSlots")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	expired := db.Dialect.timeExpr("expires_at") + " < " + db.Dialect.timeExpr("$1")
+	query := `SELECT key FROM upload_slots WHERE photo_id IS NULL AND ` + expired + `;`
+	keys, err := queryKeys(ctx, tx, query, now.UTC())
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	if err := queueUnusedObjectDeletions(ctx, tx, keys); err != nil {
+		return 0, translateError(err)
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM upload_slots WHERE `+expired+`;`, now.UTC())
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return int(n), translateError(tx.Commit())
+}
@@ -1,48 +1,76 @@
 package db
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
 
 	"github.com/yanchenm/photo-sync/models"
 )
 
-func (db Database) GetUserFromEmail(email string) (models.User, error) {
+func (db Database) GetUserFromEmail(ctx context.Context, email string) (models.User, error) {
+	ctx, end := db.begin(ctx, "GetUserFromEmail")
+	defer end()
+
 	user := models.User{}
 	query := `SELECT * FROM users WHERE email = $1;`
 
-	row := db.Conn.QueryRow(query, email)
+	row := db.Conn.QueryRowContext(ctx, query, email)
 	err := row.Scan(&user.Email, &user.Name, &user.Password, &user.CreatedAt)
 
-	switch err {
-	case sql.ErrNoRows:
-		return user, fmt.Errorf("no matching record")
-	default:
-		return user, err
-	}
+	return user, translateError(err)
 }
 
-func (db Database) AddUser(user *models.User) error {
+func (db Database) AddUser(ctx context.Context, user *models.User) error {
+	ctx, end := db.begin(ctx, "AddUser")
+	defer end()
+
 	var createdAt string
 
 	query := `INSERT INTO users (email, name, password) VALUES ($1, $2, $3) RETURNING created_at;`
-	err := db.Conn.QueryRow(query, user.Email, user.Name, user.Password).Scan(&createdAt)
+	err := db.Conn.QueryRowContext(ctx, query, user.Email, user.Name, user.Password).Scan(&createdAt)
 	if err != nil {
-		return err
+		return translateError(err)
 	}
 
 	user.CreatedAt = createdAt
 	return nil
 }
 
-func (db Database) DeleteUser(email string) error {
+// DeleteUser deletes a user, whose records the database removes in turn. Objects that the user's unfinished uploads
+// staged in storage would be left behind by that, so they are queued for deletion in the same transaction.
+func (db Database) DeleteUser(ctx context.Context, email string) error {
+	ctx, end := db.begin(ctx, "DeleteUser")
+	defer end()
+
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return translateError(err)
+	}
+
+	defer tx.Rollback()
+
+	if err := discardUploadChunks(ctx, tx, `upload_id IN (SELECT id FROM uploads WHERE username = $1)`, email); err != nil {
+		return translateError(err)
+	}
+
+	// The objects of finalized slots belong to their photos now
+	keys, err := queryKeys(ctx, tx, `SELECT key FROM upload_slots WHERE username = $1 AND photo_id IS NULL;`, email)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if err := queueObjectDeletions(ctx, tx, keys); err != nil {
+		return translateError(err)
+	}
+
 	query := `DELETE FROM users WHERE email = $1;`
-	_, err := db.Conn.Exec(query, email)
+	res, err := tx.ExecContext(ctx, query, email)
+	if err != nil {
+		return translateError(err)
+	}
 
-	switch err {
-	case sql.ErrNoRows:
-		return fmt.Errorf("no matching record")
-	default:
+	if err := expectRows(res); err != nil {
 		return err
 	}
+
+	return translateError(tx.Commit())
 }
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 
@@ -9,25 +11,131 @@ import (
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/awslabs/aws-lambda-go-api-proxy/gorillamux"
 
+	"github.com/yanchenm/photo-sync/config"
 	"github.com/yanchenm/photo-sync/server"
 )
 
-var lambdaAdapter *gorillamux.GorillaMuxAdapter
+const usage = `usage: photo-sync <command> [arguments]
 
-func init() {
+commands:
+  serve       run a standalone HTTP server
+  lambda      handle requests as an AWS Lambda function (the default when no command is given)
+  migrate     apply, undo or list database migrations
+  admin       manage users and check the configuration
+
+Settings are read from the environment and the file named by CONFIG_FILE, if any.`
+
+var (
+	lambdaServer  *server.Server
+	lambdaAdapter *gorillamux.GorillaMuxAdapter
+)
+
+// Handler handles API Gateway requests. Scheduled EventBridge events sweep storage instead, since there is no
+// background loop to do it between invocations.
+func Handler(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	defer server.FlushTraces(ctx)
+
+	var scheduled events.CloudWatchEvent
+	if err := json.Unmarshal(event, &scheduled); err == nil && scheduled.Source == "aws.events" {
+		result, err := lambdaServer.Sweep(ctx)
+		server.LogSweep(result, err)
+		return nil, err
+	}
+
+	var req events.APIGatewayProxyRequest
+	if err := json.Unmarshal(event, &req); err != nil {
+		return nil, err
+	}
+
+	return lambdaAdapter.ProxyWithContext(ctx, req)
+}
+
+func main() {
+	// Lambda runs the binary without arguments
+	command := "lambda"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	var args []string
+	if len(os.Args) > 2 {
+		args = os.Args[2:]
+	}
+
+	switch command {
+	case "serve":
+		runServe()
+	case "lambda":
+		runLambda()
+	case "migrate":
+		runMigrate(args)
+	case "admin":
+		runAdmin(args)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+func runLambda() {
 	log.Printf("lambda cold start")
-	s, err := server.Initialize(os.Getenv("POSTGRES_USER"), os.Getenv("POSTGRES_PASSWORD"), os.Getenv("POSTGRES_DB"))
+	cfg := loadConfig()
+	startTracing(cfg)
+
+	s, err := server.Initialize(cfg)
 	if err != nil {
 		log.Fatalf("error initializing server: %s", err)
 	}
 
+	lambdaServer = s
 	lambdaAdapter = gorillamux.New(s.Router)
+	lambda.Start(Handler)
 }
 
-func Handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	return lambdaAdapter.ProxyWithContext(ctx, req)
+// loadConfig loads the full configuration needed to run the server and exits if any of it is invalid
+func loadConfig() config.Config {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err == nil {
+		err = cfg.Validate()
+	}
+
+	if err == nil {
+		err = server.ConfigureLogging(cfg.Logging)
+	}
+
+	if err != nil {
+		log.Fatalf("error loading configuration: %s", err)
+	}
+
+	return cfg
 }
 
-func main() {
-	lambda.Start(Handler)
+// startTracing installs the configured tracer provider and returns the function that flushes it on exit
+func startTracing(cfg config.Config) func(context.Context) error {
+	shutdown, err := server.ConfigureTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Fatalf("error configuring tracing: %s", err)
+	}
+
+	return shutdown
+}
+
+// loadDatabaseConfig loads the configuration for commands that only need the database
+func loadDatabaseConfig() config.Config {
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err == nil {
+		err = cfg.Database.Validate()
+	}
+
+	if err == nil {
+		err = server.ConfigureLogging(cfg.Logging)
+	}
+
+	if err != nil {
+		log.Fatalf("error loading configuration: %s", err)
+	}
+
+	return cfg
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/yanchenm/photo-sync/server"
+)
+
+const migrateUsage = `usage: photo-sync migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [n]    undo the last n applied migrations (default 1)
+  status      list migrations and whether they have been applied`
+
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Println(migrateUsage)
+		os.Exit(2)
+	}
+
+	database, err := server.OpenDatabase(loadDatabaseConfig().Database)
+	if err != nil {
+		log.Fatalf("error connecting to database: %s", err)
+	}
+
+	defer database.Close()
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		count, err := database.MigrateUp(ctx)
+		if err != nil {
+			log.Fatalf("error applying migrations: %s", err)
+		}
+
+		fmt.Printf("applied %d migrations\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid number of migrations: %s", args[1])
+			}
+		}
+
+		count, err := database.MigrateDown(ctx, steps)
+		if err != nil {
+			log.Fatalf("error undoing migrations: %s", err)
+		}
+
+		fmt.Printf("undid %d migrations\n", count)
+	case "status":
+		status, err := database.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatalf("error getting migration status: %s", err)
+		}
+
+		for _, migration := range status {
+			state := "pending"
+			if migration.Applied {
+				state = "applied " + migration.AppliedAt
+			}
+
+			fmt.Printf("%4d  %-30s %s\n", migration.Version, migration.Description, state)
+		}
+	default:
+		fmt.Println(migrateUsage)
+		os.Exit(2)
+	}
+}
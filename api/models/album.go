@@ -0,0 +1,17 @@
+package models
+
+type Album struct {
+	ID             string    `json:"id"`
+	User           string    `json:"user"`
+	Name           string    `json:"name"`
+	Cover          string    `json:"cover"`
+	CoverThumbnail string    `json:"cover_thumbnail"`
+	CoverUrl       string    `json:"cover_url"`
+	Count          int       `json:"count"`
+	CreatedAt      string    `json:"created_at"`
+	Photos         PhotoList `json:"photos"`
+}
+
+type AlbumList struct {
+	Albums []Album `json:"albums"`
+}
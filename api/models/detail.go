@@ -3,10 +3,20 @@ package models
 import "time"
 
 type Detail struct {
-	ID       string    `json:"id"`
-	FileType string    `json:"file_type"`
-	Height   int       `json:"height"`
-	Width    int       `json:"width"`
-	Size     float32   `json:"size"`
-	Taken    time.Time `json:"taken"`
+	ID           string     `json:"id"`
+	FileType     string     `json:"file_type"`
+	Height       int        `json:"height"`
+	Width        int        `json:"width"`
+	Size         float32    `json:"size"`
+	Taken        *time.Time `json:"taken"`
+	CameraMake   string     `json:"camera_make"`
+	CameraModel  string     `json:"camera_model"`
+	Lens         string     `json:"lens"`
+	FocalLength  float64    `json:"focal_length"`
+	Aperture     float64    `json:"aperture"`
+	ShutterSpeed string     `json:"shutter_speed"`
+	ISO          int        `json:"iso"`
+	Latitude     *float64   `json:"latitude"`
+	Longitude    *float64   `json:"longitude"`
+	SHA256       string     `json:"sha256,omitempty"`
 }
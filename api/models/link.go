@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type ShareLink struct {
+	Token         string     `json:"token"`
+	User          string     `json:"user"`
+	Password      string     `json:"password,omitempty"`
+	HasPassword   bool       `json:"has_password"`
+	AllowDownload bool       `json:"allow_download"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	CreatedAt     string     `json:"created_at"`
+	Photos        []string   `json:"photos"`
+}
+
+func (link *ShareLink) HashPassword() error {
+	if link.Password == "" {
+		return nil
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(link.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	link.Password = string(hashedPassword)
+	return nil
+}
+
+// VerifyPassword checks password against the link, which always succeeds if the link has no password
+func (link *ShareLink) VerifyPassword(password string) bool {
+	if link.Password == "" {
+		return true
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(link.Password), []byte(password))
+	return err == nil
+}
+
+func (link *ShareLink) Expired() bool {
+	return link.ExpiresAt != nil && !time.Now().Before(*link.ExpiresAt)
+}
+
+func (link *ShareLink) BeforeSend() {
+	link.HasPassword = link.Password != ""
+	link.Password = ""
+}
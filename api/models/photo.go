@@ -10,6 +10,7 @@ type Photo struct {
 	ThumbnailUrl string `json:"thumbnail_url"`
 	UploadedAt   string `json:"uploaded_at"`
 	Details      Detail `json:"details"`
+	Permission   string `json:"permission,omitempty"`
 }
 
 type PhotoList struct {
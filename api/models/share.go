@@ -0,0 +1,41 @@
+package models
+
+// Permission is the level of access a user has to a photo. Each level includes the ones below it.
+type Permission int
+
+const (
+	PermissionNone Permission = iota
+	PermissionView
+	PermissionDownload
+	PermissionOwner
+)
+
+var permissionNames = map[Permission]string{
+	PermissionNone:     "none",
+	PermissionView:     "view",
+	PermissionDownload: "download",
+	PermissionOwner:    "owner",
+}
+
+func (p Permission) String() string {
+	return permissionNames[p]
+}
+
+// ParseSharePermission parses a permission that can be granted to another user
+func ParseSharePermission(name string) (Permission, bool) {
+	switch name {
+	case PermissionView.String():
+		return PermissionView, true
+	case PermissionDownload.String():
+		return PermissionDownload, true
+	default:
+		return PermissionNone, false
+	}
+}
+
+type Share struct {
+	PhotoID    string `json:"photo_id"`
+	Email      string `json:"email"`
+	Permission string `json:"permission"`
+	CreatedAt  string `json:"created_at"`
+}
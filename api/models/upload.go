@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Upload is a photo being uploaded in chunks. Offset is how many bytes have been received so far, and PhotoID is
+// set once the last chunk has arrived and the photo has been created.
+type Upload struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Filename  string    `json:"filename"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	PhotoID   string    `json:"photo_id,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt string    `json:"created_at"`
+}
+
+// Received reports whether every byte of the upload has arrived
+func (upload *Upload) Received() bool {
+	return upload.Offset >= upload.Length
+}
+
+// Expired reports whether an unfinished upload has gone too long without a chunk arriving
+func (upload *Upload) Expired() bool {
+	return upload.PhotoID == "" && !time.Now().Before(upload.ExpiresAt)
+}
+
+// UploadSlot is a photo that the client uploads straight to storage with a presigned request. The photo is
+// created when the client finalizes the slot after uploading.
+type UploadSlot struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Filename    string    `json:"filename"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	PhotoID     string    `json:"photo_id,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   string    `json:"created_at"`
+}
+
+func (slot *UploadSlot) Expired() bool {
+	return !time.Now().Before(slot.ExpiresAt)
+}
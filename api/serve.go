@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/signal"
+	"syscall"
+
+	"github.com/yanchenm/photo-sync/server"
+)
+
+func runServe() {
+	cfg := loadConfig()
+	shutdownTracing := startTracing(cfg)
+
+	s, err := server.Initialize(cfg)
+	if err != nil {
+		log.Fatalf("error initializing server: %s", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	runErr := s.Run(ctx)
+
+	// Close the pool before exiting either way so that the database isn't left with abandoned connections
+	if err := s.Close(); err != nil {
+		log.Printf("error closing database: %s", err)
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("error exporting traces: %s", err)
+	}
+
+	if runErr != nil {
+		log.Fatalf("error running server: %s", runErr)
+	}
+}
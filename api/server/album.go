@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// MAX_PHOTOS_PER_REQUEST is how many photos one request can add to an album or a link
+const MAX_PHOTOS_PER_REQUEST = 500
+
+type AlbumRequest struct {
+	Name   string   `json:"name"`
+	Photos []string `json:"photos"`
+	Cover  string   `json:"cover"`
+}
+
+func decodeAlbumRequest(w http.ResponseWriter, r *http.Request) (AlbumRequest, bool) {
+	req := AlbumRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request payload", err)
+		return req, false
+	}
+
+	defer r.Body.Close()
+	return req, true
+}
+
+// getOwnedAlbum loads the album in the request path and checks that it belongs to the user. If it doesn't, an
+// error response is written and false is returned.
+func (s *Server) getOwnedAlbum(w http.ResponseWriter, r *http.Request, user models.User) (models.Album, bool) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	album, err := s.DB.GetAlbumById(r.Context(), id)
+	if err != nil {
+		respondWithDBError(w, r, err, "album", "failed to get album")
+		return album, false
+	}
+
+	if album.User != user.Email {
+		respondWithError(w, r, http.StatusForbidden, "you don't have permission to view this album")
+		return album, false
+	}
+
+	return album, true
+}
+
+// checkPhotosOwned verifies that every photo exists and belongs to the user, and that there aren't more of them
+// than one request can add. If not, an error response is written and false is returned.
+func (s *Server) checkPhotosOwned(w http.ResponseWriter, r *http.Request, ids []string, user models.User) bool {
+	if len(ids) > MAX_PHOTOS_PER_REQUEST {
+		msg := fmt.Sprintf("too many photos in one request, the limit is %d", MAX_PHOTOS_PER_REQUEST)
+		respondWithError(w, r, http.StatusBadRequest, msg)
+		return false
+	}
+
+	owners, err := s.DB.GetPhotoOwners(r.Context(), ids)
+	if err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to get photos")
+		return false
+	}
+
+	for _, id := range ids {
+		owner, ok := owners[id]
+		if !ok {
+			respondWithError(w, r, http.StatusBadRequest, fmt.Sprintf("photo %s does not exist", id))
+			return false
+		}
+
+		if owner != user.Email {
+			respondWithError(w, r, http.StatusForbidden, "you don't have permission to add this photo")
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *Server) signAlbumCover(r *http.Request, album *models.Album) error {
+	if album.CoverThumbnail == "" {
+		return nil
+	}
+
+	coverUrl, err := s.signer.Sign(r.Context(), album.CoverThumbnail, album.CoverThumbnail+".jpeg")
+	if err != nil {
+		return err
+	}
+
+	album.CoverUrl = coverUrl
+	return nil
+}
+
+func (s *Server) handleGetAlbums(w http.ResponseWriter, r *http.Request, user models.User) {
+	albums, err := s.DB.GetAlbums(r.Context(), user)
+	if err != nil {
+		respondWithDBError(w, r, err, "album", "failed to get albums from database")
+		return
+	}
+
+	for i := range albums.Albums {
+		if err := s.signAlbumCover(r, &albums.Albums[i]); err != nil {
+			msg := fmt.Sprintf("error signing cover url for album %s", albums.Albums[i].ID)
+			logErrorAndRespond(w, r, http.StatusInternalServerError, msg, err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, albums)
+}
+
+func (s *Server) handleCreateAlbum(w http.ResponseWriter, r *http.Request, user models.User) {
+	req, ok := decodeAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Name == "" {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("[name]"))
+		return
+	}
+
+	if !s.checkPhotosOwned(w, r, req.Photos, user) {
+		return
+	}
+
+	album := models.Album{
+		ID:   ksuid.New().String(),
+		User: user.Email,
+		Name: req.Name,
+	}
+
+	if err := s.DB.AddAlbum(r.Context(), &album, req.Photos); err != nil {
+		respondWithDBError(w, r, err, "album", "failed to create album")
+		return
+	}
+
+	album, err := s.DB.GetAlbumById(r.Context(), album.ID)
+	if err != nil {
+		respondWithDBError(w, r, err, "album", "failed to get album")
+		return
+	}
+
+	if err := s.signAlbumCover(r, &album); err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "error signing cover url for album", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, album)
+}
+
+func (s *Server) handleGetAlbumByID(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	photos, err := s.DB.GetAlbumPhotos(r.Context(), album.ID)
+	if err != nil {
+		respondWithDBError(w, r, err, "album", "failed to get album photos from database")
+		return
+	}
+
+	if !s.populatePhotoList(w, r, photos, signAllOriginals) {
+		return
+	}
+
+	if err := s.signAlbumCover(r, &album); err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "error signing cover url for album", err)
+		return
+	}
+
+	album.Photos = *photos
+	respondWithJSON(w, http.StatusOK, album)
+}
+
+func (s *Server) handleRenameAlbum(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if req.Name == "" {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("[name]"))
+		return
+	}
+
+	if err := s.DB.RenameAlbum(r.Context(), album.ID, req.Name); err != nil {
+		respondWithDBError(w, r, err, "album", "failed to rename album")
+		return
+	}
+
+	album.Name = req.Name
+
+	if err := s.signAlbumCover(r, &album); err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "error signing cover url for album", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, album)
+}
+
+func (s *Server) handleDeleteAlbum(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	if err := s.DB.DeleteAlbum(r.Context(), album.ID); err != nil {
+		respondWithDBError(w, r, err, "album", "failed to delete album")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleAddAlbumPhotos(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if len(req.Photos) == 0 {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("[photos]"))
+		return
+	}
+
+	if !s.checkPhotosOwned(w, r, req.Photos, user) {
+		return
+	}
+
+	if err := s.DB.AddPhotosToAlbum(r.Context(), album.ID, req.Photos); err != nil {
+		respondWithDBError(w, r, err, "album", "failed to add photos to album")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleRemoveAlbumPhoto(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	params := mux.Vars(r)
+	photoId := params["photoId"]
+
+	if err := s.DB.RemovePhotoFromAlbum(r.Context(), album.ID, photoId); err != nil {
+		respondWithDBError(w, r, err, "photo in album", "failed to remove photo from album")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleReorderAlbum(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// The new order must list every photo in the album exactly once
+	seen := make(map[string]bool)
+	for _, id := range req.Photos {
+		if seen[id] {
+			logErrorAndRespond(w, r, http.StatusBadRequest, "duplicate photo in order", fmt.Errorf("%s", id))
+			return
+		}
+		seen[id] = true
+	}
+
+	if len(req.Photos) != album.Count {
+		msg := fmt.Sprintf("order must contain all %d photos in the album", album.Count)
+		logErrorAndRespond(w, r, http.StatusBadRequest, msg, fmt.Errorf("got %d photos", len(req.Photos)))
+		return
+	}
+
+	err := s.DB.ReorderAlbum(r.Context(), album.ID, req.Photos)
+	if errors.Is(err, db.ErrNotFound) {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "order contains photos that are not in album", err)
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err, "album", "failed to reorder album")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleSetAlbumCover(w http.ResponseWriter, r *http.Request, user models.User) {
+	album, ok := s.getOwnedAlbum(w, r, user)
+	if !ok {
+		return
+	}
+
+	req, ok := decodeAlbumRequest(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.DB.SetAlbumCover(r.Context(), album.ID, req.Cover)
+	if errors.Is(err, db.ErrNotFound) {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "cover must be a photo in the album", err)
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err, "album", "failed to set album cover")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+)
+
+func TestConcurrentAddPhotosToAlbum(t *testing.T) {
+	const additions = 8
+
+	s := newTestServer(t)
+	ctx := context.Background()
+	user, _ := addTestUser(t, s, "owner@example.com")
+
+	album := models.Album{ID: "2DqBLx3DdLpQ5q9AyIBFMwzUhHj", User: user.Email, Name: "album"}
+	if err := s.DB.AddAlbum(ctx, &album, nil); err != nil {
+		t.Fatalf("failed to add album: %s", err)
+	}
+
+	ids := make([]string, additions)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("2DqBLx3DdLpQ5q9AyIBFMwzUh%02d", i)
+		addTestPhoto(t, s, user, ids[i])
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			if err := s.DB.AddPhotosToAlbum(ctx, album.ID, []string{id}); err != nil {
+				t.Errorf("failed to add photo %s to album: %s", id, err)
+			}
+		}(id)
+	}
+
+	wg.Wait()
+
+	rows, err := s.DB.(db.Database).Conn.QueryContext(ctx, `SELECT position FROM album_photos WHERE album_id = $1;`, album.ID)
+	if err != nil {
+		t.Fatalf("failed to get positions: %s", err)
+	}
+
+	defer rows.Close()
+
+	positions := make(map[int]bool)
+	for rows.Next() {
+		var position int
+		if err := rows.Scan(&position); err != nil {
+			t.Fatalf("failed to scan position: %s", err)
+		}
+
+		if positions[position] {
+			t.Errorf("more than one photo at position %d", position)
+		}
+
+		positions[position] = true
+	}
+
+	if len(positions) != additions {
+		t.Errorf("expected %d photos in the album, got %d", additions, len(positions))
+	}
+}
+
+func TestCreateAlbumChecksPhotos(t *testing.T) {
+	s := newTestServer(t)
+	owner, token := addTestUser(t, s, "owner@example.com")
+	other, _ := addTestUser(t, s, "other@example.com")
+
+	mine := addTestPhoto(t, s, owner, "2DqFgDEFmZ8sN0dJ7pWw1PDhM01")
+	theirs := addTestPhoto(t, s, other, "2DqFgDEFmZ8sN0dJ7pWw1PDhM02")
+
+	tooMany := make([]string, MAX_PHOTOS_PER_REQUEST+1)
+	for i := range tooMany {
+		tooMany[i] = mine.ID
+	}
+
+	tests := []struct {
+		name   string
+		photos []string
+		status int
+	}{
+		{"owned", []string{mine.ID}, http.StatusCreated},
+		{"missing", []string{mine.ID, "2DqFgDEFmZ8sN0dJ7pWw1PDhM03"}, http.StatusBadRequest},
+		{"not owned", []string{mine.ID, theirs.ID}, http.StatusForbidden},
+		{"too many", tooMany, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		body, _ := json.Marshal(AlbumRequest{Name: test.name, Photos: test.photos})
+		r := httptest.NewRequest(http.MethodPost, "/albums", bytes.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		if w := serve(s, r); w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body)
+		}
+	}
+}
@@ -2,14 +2,17 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
 
+	"github.com/yanchenm/photo-sync/db"
 	"github.com/yanchenm/photo-sync/models"
 )
 
@@ -56,7 +59,7 @@ func (s *Server) authenticate(next func(http.ResponseWriter, *http.Request, mode
 			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 				return nil, fmt.Errorf("unexpected signing method")
 			}
-			return []byte(os.Getenv("ACCESS_TOKEN_KEY")), nil
+			return []byte(s.Config.Auth.AccessTokenKey), nil
 		})
 
 		if err != nil || !accessToken.Valid {
@@ -64,6 +67,8 @@ func (s *Server) authenticate(next func(http.ResponseWriter, *http.Request, mode
 			return
 		}
 
+		addLogFields(r, log.Fields{"user": claims.Email})
+		addSpanAttributes(r, semconv.EnduserID(claims.Email))
 		next(w, r, models.User{Email: claims.Email})
 	}
 }
@@ -72,51 +77,59 @@ func (s *Server) login(w http.ResponseWriter, r *http.Request) {
 	user := models.User{}
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&user); err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid request payload", err)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request payload", err)
 		return
 	}
 
+	addLogFields(r, log.Fields{"user": user.Email})
+
 	defer r.Body.Close()
 
 	if user.Email == "" || user.Password == "" {
-		logErrorAndRespond(w, http.StatusBadRequest, "missing required values", nil)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required values", nil)
 		return
 	}
 
-	dbUser, err := s.DB.GetUserFromEmail(user.Email)
-	if err != nil {
+	dbUser, err := s.DB.GetUserFromEmail(r.Context(), user.Email)
+	if errors.Is(err, db.ErrNotFound) {
+		s.metrics.failedLogins.WithLabelValues("unknown_user").Inc()
 		respondWithJSON(w, http.StatusUnauthorized, nil)
 		return
+	} else if err != nil {
+		respondWithDBError(w, r, err, "user", "failed to get user")
+		return
 	}
 
 	if !dbUser.VerifyPassword(user.Password) {
+		s.metrics.failedLogins.WithLabelValues("wrong_password").Inc()
 		respondWithJSON(w, http.StatusUnauthorized, nil)
 		return
 	}
 
-	accessTokenExpiration := time.Now().Add(15 * time.Minute)
-	accessTokenString, err := generateToken(user.Email, os.Getenv("ACCESS_TOKEN_KEY"), accessTokenExpiration)
+	accessTokenExpiration := time.Now().Add(s.Config.Auth.AccessTokenLifetime)
+	accessTokenString, err := generateToken(user.Email, s.Config.Auth.AccessTokenKey, accessTokenExpiration)
 
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get tokens", err)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to get tokens", err)
 		return
 	}
 
-	refreshTokenExpiration := time.Now().Add(14 * 24 * time.Hour)
-	refreshTokenString, err := generateToken(user.Email, os.Getenv("REFRESH_TOKEN_KEY"), refreshTokenExpiration)
+	refreshTokenExpiration := time.Now().Add(s.Config.Auth.RefreshTokenLifetime)
+	refreshTokenString, err := generateToken(user.Email, s.Config.Auth.RefreshTokenKey, refreshTokenExpiration)
 
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get tokens", err)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to get tokens", err)
 		return
 	}
 
-	err = s.DB.AddToken(models.RefreshToken{
+	err = s.DB.AddToken(r.Context(), models.RefreshToken{
 		Email: user.Email,
 		Token: refreshTokenString,
 	})
 
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to register new token", err)
+		respondWithDBError(w, r, err, "refresh token", "failed to register new token")
+		return
 	}
 
 	dbUser.BeforeSend()
@@ -149,10 +162,10 @@ func (s *Server) refreshAuth(w http.ResponseWriter, r *http.Request) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method")
 		}
-		return []byte(os.Getenv("REFRESH_TOKEN_KEY")), nil
+		return []byte(s.Config.Auth.RefreshTokenKey), nil
 	})
 
-	isRevoked := !s.DB.TokenValid(models.RefreshToken{
+	isRevoked := !s.DB.TokenValid(r.Context(), models.RefreshToken{
 		Email: claims.Email,
 		Token: refreshTokenString,
 	})
@@ -162,45 +175,51 @@ func (s *Server) refreshAuth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	accessTokenExpiration := time.Now().Add(15 * time.Minute)
-	accessTokenString, err := generateToken(claims.Email, os.Getenv("ACCESS_TOKEN_KEY"), accessTokenExpiration)
+	accessTokenExpiration := time.Now().Add(s.Config.Auth.AccessTokenLifetime)
+	accessTokenString, err := generateToken(claims.Email, s.Config.Auth.AccessTokenKey, accessTokenExpiration)
 
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get tokens", err)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to get tokens", err)
 		return
 	}
 
-	refreshTokenExpiration := time.Now().Add(14 * 24 * time.Hour)
-	newRefreshTokenString, err := generateToken(claims.Email, os.Getenv("REFRESH_TOKEN_KEY"), refreshTokenExpiration)
+	refreshTokenExpiration := time.Now().Add(s.Config.Auth.RefreshTokenLifetime)
+	newRefreshTokenString, err := generateToken(claims.Email, s.Config.Auth.RefreshTokenKey, refreshTokenExpiration)
 
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get tokens", err)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to get tokens", err)
 		return
 	}
 
-	err = s.DB.DeleteToken(models.RefreshToken{
+	err = s.DB.DeleteToken(r.Context(), models.RefreshToken{
 		Email: claims.Email,
 		Token: refreshTokenString,
 	})
 
-	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to remove old token", err)
+	if errors.Is(err, db.ErrNotFound) {
+		// The token was used by a concurrent refresh
+		respondWithJSON(w, http.StatusUnauthorized, nil)
+		return
+	} else if err != nil {
+		respondWithDBError(w, r, err, "refresh token", "failed to remove old token")
 		return
 	}
 
-	err = s.DB.AddToken(models.RefreshToken{
+	err = s.DB.AddToken(r.Context(), models.RefreshToken{
 		Email: claims.Email,
 		Token: newRefreshTokenString,
 	})
 
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to register new token", err)
+		respondWithDBError(w, r, err, "refresh token", "failed to register new token")
 		return
 	}
 
-	user, err := s.DB.GetUserFromEmail(claims.Email)
+	s.metrics.tokenRotations.Inc()
+
+	user, err := s.DB.GetUserFromEmail(r.Context(), claims.Email)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get user", err)
+		respondWithDBError(w, r, err, "user", "failed to get user")
 		return
 	}
 
@@ -222,7 +241,7 @@ func (s *Server) refreshAuth(w http.ResponseWriter, r *http.Request) {
 func (s *Server) logout(w http.ResponseWriter, r *http.Request, user models.User) {
 	c, err := r.Cookie("refresh")
 	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "no refresh token received", err)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "no refresh token received", err)
 		return
 	}
 
@@ -232,9 +251,9 @@ func (s *Server) logout(w http.ResponseWriter, r *http.Request, user models.User
 		Token: refreshTokenString,
 	}
 
-	// Invalidate the refresh token
-	if err := s.DB.DeleteToken(refreshToken); err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to unregister token", err)
+	// Invalidate the refresh token, which may already have been revoked
+	if err := s.DB.DeleteToken(r.Context(), refreshToken); err != nil && !errors.Is(err, db.ErrNotFound) {
+		respondWithDBError(w, r, err, "refresh token", "failed to unregister token")
 		return
 	}
 
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// BatchUploadResult is the outcome of uploading one photo of a batch. Photo is set if the photo was created, and
+// otherwise Status and Error say why it wasn't. Duplicate is set if the photo had already been uploaded, in which
+// case Photo is the existing photo.
+type BatchUploadResult struct {
+	Filename  string        `json:"filename"`
+	Success   bool          `json:"success"`
+	Photo     *models.Photo `json:"photo,omitempty"`
+	Duplicate bool          `json:"duplicate,omitempty"`
+	Status    int           `json:"status,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type BatchUploadResponse struct {
+	Results  []*BatchUploadResult `json:"results"`
+	Uploaded int                  `json:"uploaded"`
+	Failed   int                  `json:"failed"`
+
+	// Error is why the rest of the form couldn't be read, if the batch was cut short
+	Error string `json:"error,omitempty"`
+}
+
+func (result *BatchUploadResult) fail(err *httpError) {
+	result.Status = err.status
+	result.Error = err.message
+}
+
+// batchJob is a photo of a batch that has been read from the form and is waiting to be saved
+type batchJob struct {
+	r           *http.Request
+	onDuplicate string
+	span        trace.Span
+	file        *os.File
+	result      *BatchUploadResult
+}
+
+// handleUploadPhotoBatch creates a photo from every photo part of a multipart form. A photo that can't be created
+// is reported in its result without failing the rest of the batch.
+//
+// Batches don't take an Idempotency-Key, since a retry may resend only some of the photos. Retrying a batch is
+// still safe, because a photo that was already uploaded is matched by its content.
+//
+// Parts of a form can only be read in order, so each photo is copied to a temporary file as it arrives and handed
+// to a pool of workers. Reading waits while every worker is busy, which bounds how many photos are held on disk.
+func (s *Server) handleUploadPhotoBatch(w http.ResponseWriter, r *http.Request, user models.User) {
+	onDuplicate, err := parseOnDuplicate(r)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid query parameters", err)
+		return
+	}
+
+	if r.Header.Get(IDEMPOTENCY_KEY_HEADER) != "" {
+		respondWithError(w, r, http.StatusBadRequest,
+			IDEMPOTENCY_KEY_HEADER+" isn't supported for batches, photos that were already uploaded are matched by their content")
+		return
+	}
+
+	maxFiles := s.Config.Upload.MaxBatchFiles
+	r.Body = http.MaxBytesReader(w, r.Body, s.Config.Upload.MaxSize*int64(maxFiles)+FORM_ENVELOPE_SIZE)
+
+	form, err := r.MultipartReader()
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "failed to parse form", err)
+		return
+	}
+
+	jobs := make(chan batchJob)
+	var workers sync.WaitGroup
+
+	for i := 0; i < s.Config.Upload.BatchWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				s.saveBatchPhoto(job, user)
+			}
+		}()
+	}
+
+	response := BatchUploadResponse{}
+	var formErr *httpError
+
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			formErr = s.readError("failed to parse form", err)
+			break
+		}
+
+		if !isPhotoPart(part) {
+			part.Close()
+			continue
+		}
+
+		result := &BatchUploadResult{Filename: part.FileName()}
+		response.Results = append(response.Results, result)
+
+		if len(response.Results) > maxFiles {
+			part.Close()
+			result.fail(&httpError{
+				status:  http.StatusRequestEntityTooLarge,
+				message: fmt.Sprintf("too many photos in one batch, the limit is %d", maxFiles),
+			})
+			continue
+		}
+
+		file, spoolErr := s.spoolPart(part)
+		part.Close()
+
+		if spoolErr != nil {
+			result.fail(spoolErr)
+
+			// A photo over the limit is skipped, but the form can't be read any further if reading it failed
+			if spoolErr.status != http.StatusRequestEntityTooLarge || spoolErr.err != nil {
+				formErr = spoolErr
+				break
+			}
+
+			continue
+		}
+
+		fileRequest, span := batchRequest(r, len(response.Results)-1, result.Filename)
+		jobs <- batchJob{r: fileRequest, onDuplicate: onDuplicate, span: span, file: file, result: result}
+	}
+
+	close(jobs)
+	workers.Wait()
+
+	if formErr != nil {
+		logHTTPError(r, formErr)
+
+		if len(response.Results) == 0 {
+			respondWithError(w, r, formErr.status, formErr.message)
+			return
+		}
+
+		response.Error = formErr.message
+	} else if len(response.Results) == 0 {
+		respondWithError(w, r, http.StatusBadRequest, "invalid file upload")
+		return
+	}
+
+	for _, result := range response.Results {
+		if result.Success {
+			response.Uploaded++
+		} else {
+			response.Failed++
+		}
+	}
+
+	addLogFields(r, log.Fields{"uploaded": response.Uploaded, "failed": response.Failed})
+	addSpanAttributes(r, attribute.Int("batch.uploaded", response.Uploaded), attribute.Int("batch.failed", response.Failed))
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// spoolPart copies a photo from the form to a temporary file, so that the rest of the form can be read while it
+// is saved. The photo is limited to the same size as any other upload.
+func (s *Server) spoolPart(part *multipart.Part) (*os.File, *httpError) {
+	file, err := os.CreateTemp("", "photo-sync-batch-*")
+	if err != nil {
+		return nil, &httpError{http.StatusInternalServerError, "failed to store photo", err}
+	}
+
+	stream := newPhotoStream(part, s.Config.Upload.MaxSize)
+	_, err = io.Copy(file, stream)
+
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			removeSpooledFile(file)
+			return nil, &httpError{http.StatusInternalServerError, "failed to store photo", err}
+		}
+
+		return file, nil
+	}
+
+	removeSpooledFile(file)
+
+	switch {
+	case stream.err != nil:
+		return nil, s.readError("failed to read photo", stream.err)
+	case stream.tooLarge:
+		return nil, s.tooLargeError(nil)
+	default:
+		return nil, &httpError{http.StatusInternalServerError, "failed to store photo", err}
+	}
+}
+
+func removeSpooledFile(file *os.File) {
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		log.WithError(err).WithField("path", file.Name()).Warn("failed to remove temporary upload file")
+	}
+}
+
+// batchRequest returns a copy of r for saving one photo of a batch. Photos are saved at the same time, so each
+// one gets its own span and its own copy of the request's logger rather than adding fields to the shared ones.
+func batchRequest(r *http.Request, index int, fileName string) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(r.Context(), "upload.batch.photo", trace.WithAttributes(
+		attribute.Int("batch.index", index),
+		attribute.String("photo.filename", fileName),
+	))
+
+	l := &requestLog{
+		id:    requestID(r),
+		entry: logger(r).WithFields(log.Fields{"batch_index": index, "filename": fileName}),
+	}
+
+	return r.WithContext(context.WithValue(ctx, requestLogKey, l)), span
+}
+
+// saveBatchPhoto saves a photo that was read from a batch and records how it went in the job's result
+func (s *Server) saveBatchPhoto(job batchJob, user models.User) {
+	defer job.span.End()
+	defer removeSpooledFile(job.file)
+
+	photo, duplicate, err := s.savePhoto(job.r, user, job.result.Filename, job.file)
+	if err == nil && duplicate && job.onDuplicate == ON_DUPLICATE_REJECT {
+		err = duplicateError(photo)
+	}
+
+	if err != nil {
+		logHTTPError(job.r, err)
+		job.result.fail(err)
+		return
+	}
+
+	job.result.Success = true
+	job.result.Photo = &photo
+	job.result.Duplicate = duplicate
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testFile is a file sent in a batch upload
+type testFile struct {
+	name string
+	data []byte
+}
+
+// batchUpload sends files as a batch and returns the decoded response
+func batchUpload(t *testing.T, s *Server, token, target string, files ...testFile) BatchUploadResponse {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	for _, file := range files {
+		part, err := form.CreateFormFile("photo", file.name)
+		if err != nil {
+			t.Fatalf("failed to create form: %s", err)
+		}
+
+		part.Write(file.data)
+	}
+
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, target, body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	res := BatchUploadResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	if len(res.Results) != len(files) {
+		t.Fatalf("expected %d results, got %d", len(files), len(res.Results))
+	}
+
+	return res
+}
+
+func TestBatchUploadPartialFailures(t *testing.T) {
+	s := newTestServer(t)
+	_, token := addTestUser(t, s, "owner@example.com")
+
+	photo := testJPEG(t, 8)
+	large := testJPEG(t, 9)
+	large = append(large, make([]byte, len(photo))...)
+	s.Config.Upload.MaxSize = int64(len(photo))
+
+	res := batchUpload(t, s, token, "/photos/batch?on_duplicate=reject",
+		testFile{"photo.jpeg", photo},
+		testFile{"notes.txt", []byte("not a photo")},
+		testFile{"again.jpeg", photo},
+		testFile{"large.jpeg", large},
+	)
+
+	want := []struct {
+		success bool
+		status  int
+	}{
+		{true, 0},
+		{false, http.StatusBadRequest},
+		{false, http.StatusConflict},
+		{false, http.StatusRequestEntityTooLarge},
+	}
+
+	for i, result := range res.Results {
+		if result.Success != want[i].success || result.Status != want[i].status {
+			t.Errorf("%s: expected success %t with status %d, got %t with status %d: %s",
+				result.Filename, want[i].success, want[i].status, result.Success, result.Status, result.Error)
+		}
+	}
+
+	if res.Uploaded != 1 || res.Failed != 3 {
+		t.Errorf("expected 1 photo uploaded and 3 failed, got %d and %d", res.Uploaded, res.Failed)
+	}
+
+	// Without rejecting duplicates, a photo that was already uploaded is returned again
+	res = batchUpload(t, s, token, "/photos/batch", testFile{"again.jpeg", photo})
+	if result := res.Results[0]; !result.Success || !result.Duplicate || result.Photo == nil {
+		t.Errorf("expected the duplicate to succeed with the existing photo, got %+v", result)
+	}
+}
+
+func TestBatchUploadTooManyFiles(t *testing.T) {
+	s := newTestServer(t)
+	_, token := addTestUser(t, s, "owner@example.com")
+	s.Config.Upload.MaxBatchFiles = 2
+
+	res := batchUpload(t, s, token, "/photos/batch",
+		testFile{"one.jpeg", testJPEG(t, 10)},
+		testFile{"two.jpeg", testJPEG(t, 11)},
+		testFile{"three.jpeg", testJPEG(t, 12)},
+	)
+
+	for i, result := range res.Results[:2] {
+		if !result.Success {
+			t.Errorf("photo %d: expected success, got status %d: %s", i, result.Status, result.Error)
+		}
+	}
+
+	if result := res.Results[2]; result.Success || result.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the photo over the limit to fail with status 413, got %t with status %d", result.Success, result.Status)
+	}
+
+	if res.Uploaded != 2 || res.Failed != 1 {
+		t.Errorf("expected 2 photos uploaded and 1 failed, got %d and %d", res.Uploaded, res.Failed)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/disintegration/imageorient"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+// ORPHAN_GRACE_PERIOD is how old an unreferenced object must be before it is deleted. Uploads write their objects
+// before the photo is added to the database, so newer objects may belong to an upload that is still in progress.
+const ORPHAN_GRACE_PERIOD = 24 * time.Hour
+
+type ConsistencyOptions struct {
+	// Repair deletes orphaned objects that are older than the grace period and regenerates missing thumbnails.
+	// Otherwise the check only reports what it finds.
+	Repair      bool
+	GracePeriod time.Duration
+}
+
+type OrphanedObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Deleted      bool      `json:"deleted"`
+}
+
+type MissingObject struct {
+	PhotoID     string `json:"photo_id"`
+	Key         string `json:"key"`
+	Regenerated bool   `json:"regenerated,omitempty"`
+}
+
+// ConsistencyReport compares storage with the photos table. Missing photos have lost their original, which can't
+// be repaired automatically, while missing thumbnails can be regenerated from the original.
+type ConsistencyReport struct {
+	Repair            bool             `json:"repair"`
+	PhotosChecked     int              `json:"photos_checked"`
+	ObjectsChecked    int              `json:"objects_checked"`
+	PurgedObjects     int              `json:"purged_objects"`
+	OrphanedObjects   []OrphanedObject `json:"orphaned_objects"`
+	MissingPhotos     []MissingObject  `json:"missing_photos"`
+	MissingThumbnails []MissingObject  `json:"missing_thumbnails"`
+	Errors            []string         `json:"errors,omitempty"`
+}
+
+// CheckConsistency lists every object in storage and compares it with the keys and thumbnails in the photos
+// table. Photos are loaded before storage is listed, so a photo uploaded during the check shows up as orphaned
+// objects, which the grace period protects, rather than as missing objects.
+func (s *Server) CheckConsistency(ctx context.Context, opts ConsistencyOptions) (*ConsistencyReport, error) {
+	report := &ConsistencyReport{
+		Repair:            opts.Repair,
+		OrphanedObjects:   []OrphanedObject{},
+		MissingPhotos:     []MissingObject{},
+		MissingThumbnails: []MissingObject{},
+	}
+
+	// Objects already queued for deletion are known orphans, so they are deleted first without waiting out the
+	// grace period, along with whatever expired uploads staged. Expired idempotency keys are forgotten too.
+	if opts.Repair {
+		sweep, err := s.Sweep(ctx)
+		report.PurgedObjects = sweep.PurgedObjects
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, err := range joined.Unwrap() {
+				report.Errors = append(report.Errors, err.Error())
+			}
+		}
+	}
+
+	photos, err := s.DB.GetPhotoObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report.PhotosChecked = len(photos)
+
+	// Chunks of unfinished uploads are referenced until the upload finishes or expires
+	chunks, err := s.DB.GetUploadObjects(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make(map[string]storage.ObjectInfo)
+	err = s.Storage.List(ctx, func(info storage.ObjectInfo) error {
+		objects[info.Key] = info
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage: %w", err)
+	}
+
+	report.ObjectsChecked = len(objects)
+
+	referenced := make(map[string]bool, 2*len(photos)+len(chunks))
+	for _, key := range chunks {
+		referenced[key] = true
+	}
+
+	for _, photo := range photos {
+		referenced[photo.Key] = true
+		referenced[photo.Thumbnail] = true
+
+		if _, ok := objects[photo.Key]; !ok {
+			report.MissingPhotos = append(report.MissingPhotos, MissingObject{PhotoID: photo.ID, Key: photo.Key})
+			continue
+		}
+
+		// An empty thumbnail is as good as a missing one
+		if info, ok := objects[photo.Thumbnail]; !ok || info.Size == 0 {
+			missing := MissingObject{PhotoID: photo.ID, Key: photo.Thumbnail}
+
+			if opts.Repair {
+				if err := s.regenerateThumbnail(ctx, photo.Key, photo.Thumbnail); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("failed to regenerate %s: %s", photo.Thumbnail, err))
+				} else {
+					missing.Regenerated = true
+				}
+			}
+
+			report.MissingThumbnails = append(report.MissingThumbnails, missing)
+		}
+	}
+
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for key, info := range objects {
+		if referenced[key] {
+			continue
+		}
+
+		orphan := OrphanedObject{Key: key, Size: info.Size, LastModified: info.LastModified}
+
+		if opts.Repair && info.LastModified.Before(cutoff) {
+			if err := s.Storage.Delete(ctx, key); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("failed to delete %s: %s", key, err))
+			} else {
+				orphan.Deleted = true
+			}
+		}
+
+		report.OrphanedObjects = append(report.OrphanedObjects, orphan)
+	}
+
+	sort.Slice(report.OrphanedObjects, func(i, j int) bool {
+		return report.OrphanedObjects[i].Key < report.OrphanedObjects[j].Key
+	})
+
+	return report, nil
+}
+
+// regenerateThumbnail recreates a thumbnail from the original photo
+func (s *Server) regenerateThumbnail(ctx context.Context, key, thumbnailKey string) error {
+	body, err := s.Storage.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	defer body.Close()
+
+	img, _, err := imageorient.Decode(body)
+	if err != nil {
+		return err
+	}
+
+	thumbnail, err := encodeThumbnail(img, s.Config.Upload.ThumbnailSize)
+	if err != nil {
+		return err
+	}
+
+	return s.Storage.Put(ctx, thumbnailKey, thumbnail)
+}
+
+// handleCheckConsistency reports on storage when called with GET and repairs it when called with POST. The grace
+// period for orphaned objects can be changed with the grace parameter.
+func (s *Server) handleCheckConsistency(w http.ResponseWriter, r *http.Request) {
+	if s.Config.AdminToken == "" {
+		respondWithError(w, r, http.StatusNotFound, "admin endpoints are disabled")
+		return
+	}
+
+	if !hasBearerToken(r, s.Config.AdminToken) {
+		respondWithJSON(w, http.StatusUnauthorized, nil)
+		return
+	}
+
+	opts := ConsistencyOptions{
+		Repair:      r.Method == http.MethodPost,
+		GracePeriod: ORPHAN_GRACE_PERIOD,
+	}
+
+	if grace := r.FormValue("grace"); grace != "" {
+		duration, err := time.ParseDuration(grace)
+		if err != nil || duration < 0 {
+			respondWithError(w, r, http.StatusBadRequest, "grace must be a duration such as 24h")
+			return
+		}
+
+		opts.GracePeriod = duration
+	}
+
+	report, err := s.CheckConsistency(r.Context(), opts)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to check storage", err)
+		return
+	}
+
+	logger(r).WithFields(log.Fields{
+		"repair":             report.Repair,
+		"orphaned_objects":   len(report.OrphanedObjects),
+		"missing_photos":     len(report.MissingPhotos),
+		"missing_thumbnails": len(report.MissingThumbnails),
+	}).Info("checked storage consistency")
+
+	respondWithJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/yanchenm/photo-sync/db"
+)
+
+// pageCursor is the payload of the opaque cursor tokens handed out by photo listings. It records the sort order
+// it was created for so that following it continues the same listing.
+type pageCursor struct {
+	Sort      string `json:"s"`
+	Ascending bool   `json:"a"`
+	Value     string `json:"v"`
+	ID        string `json:"i"`
+	Before    bool   `json:"b,omitempty"`
+}
+
+func (s *Server) cursorKey() []byte {
+	// Derive a separate key so that cursors can never be confused with access tokens
+	mac := hmac.New(sha256.New, []byte(s.Config.Auth.AccessTokenKey))
+	mac.Write([]byte("photo-cursor"))
+	return mac.Sum(nil)
+}
+
+func (s *Server) encodeCursor(filter db.PhotoFilter, position db.PhotoCursor, before bool) (string, error) {
+	payload, err := json.Marshal(pageCursor{
+		Sort:      filter.Sort,
+		Ascending: filter.Ascending,
+		Value:     position.Value,
+		ID:        position.ID,
+		Before:    before,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, s.cursorKey())
+	mac.Write(payload)
+
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *Server) decodeCursor(token string) (pageCursor, error) {
+	cursor := pageCursor{}
+	encoding := base64.RawURLEncoding
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return cursor, fmt.Errorf("malformed cursor")
+	}
+
+	payload, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return cursor, fmt.Errorf("malformed cursor")
+	}
+
+	signature, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return cursor, fmt.Errorf("malformed cursor")
+	}
+
+	mac := hmac.New(sha256.New, s.cursorKey())
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return cursor, fmt.Errorf("invalid cursor signature")
+	}
+
+	if err := json.Unmarshal(payload, &cursor); err != nil {
+		return cursor, fmt.Errorf("malformed cursor")
+	}
+
+	return cursor, nil
+}
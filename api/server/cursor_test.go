@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+)
+
+func TestPhotoCursorsAreStable(t *testing.T) {
+	s := newTestServer(t)
+	user, token := addTestUser(t, s, "owner@example.com")
+
+	var want []string
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		id := "2DqDp0tWqTnXKyTA8IwkJzDxW0" + name
+		addTestPhoto(t, s, user, id, func(photo *models.Photo) { photo.Filename = name + ".jpeg" })
+		want = append(want, id)
+	}
+
+	get := func(query string) GetPhotosResponse {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/photos?sort=filename&order=asc&count=2&"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := serve(s, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", query, w.Code, w.Body)
+		}
+
+		res := GetPhotosResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: failed to decode response: %s", query, err)
+		}
+
+		return res
+	}
+
+	ids := func(res GetPhotosResponse) []string {
+		var ids []string
+		for _, photo := range res.Items.Photos {
+			ids = append(ids, photo.ID)
+		}
+		return ids
+	}
+
+	// Follow the next cursors to the end, then the previous cursors back to the start
+	pages := []GetPhotosResponse{get("")}
+	for pages[len(pages)-1].NextCursor != "" {
+		pages = append(pages, get("cursor="+url.QueryEscape(pages[len(pages)-1].NextCursor)))
+	}
+
+	var got []string
+	for _, page := range pages {
+		got = append(got, ids(page)...)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected photos %v following next cursors, got %v", want, got)
+	}
+
+	for i := len(pages) - 1; i > 0; i-- {
+		prev := get("cursor=" + url.QueryEscape(pages[i].PrevCursor))
+		if !reflect.DeepEqual(ids(prev), ids(pages[i-1])) {
+			t.Errorf("expected page %d to be %v following its previous cursor, got %v", i-1, ids(pages[i-1]), ids(prev))
+		}
+	}
+}
+
+func TestRejectInvalidPhotoCursors(t *testing.T) {
+	s := newTestServer(t)
+	user, token := addTestUser(t, s, "owner@example.com")
+
+	for _, id := range []string{"2DqDp0tWqTnXKyTA8IwkJzDxW01", "2DqDp0tWqTnXKyTA8IwkJzDxW02"} {
+		addTestPhoto(t, s, user, id)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/photos?count=1&"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return serve(s, r)
+	}
+
+	w := get("sort=filename")
+	res := GetPhotosResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.NextCursor == "" {
+		t.Fatalf("expected a next cursor, got %d: %s", w.Code, w.Body)
+	}
+
+	payload, sig, _ := strings.Cut(res.NextCursor, ".")
+	tampered, err := s.encodeCursor(db.PhotoFilter{Sort: db.SortSize}, db.PhotoCursor{Value: "0", ID: "2DqDp0tWqTnXKyTA8IwkJzDxW01"}, false)
+	if err != nil {
+		t.Fatalf("failed to create cursor: %s", err)
+	}
+	tamperedPayload, _, _ := strings.Cut(tampered, ".")
+
+	tests := map[string]string{
+		"tampered signature": payload + "." + strings.Repeat("A", len(sig)),
+		"tampered payload":   tamperedPayload + "." + sig,
+		"malformed":          "not-a-cursor",
+	}
+
+	for name, cursor := range tests {
+		if w := get("cursor=" + url.QueryEscape(cursor)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", name, w.Code, w.Body)
+		}
+	}
+
+	for _, query := range []string{"sort=size", "sort=filename&order=asc"} {
+		if w := get(query + "&cursor=" + url.QueryEscape(res.NextCursor)); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected a cursor for a different sort to be rejected with status 400, got %d: %s", query, w.Code, w.Body)
+		}
+	}
+
+	if w := get("sort=filename&cursor=" + url.QueryEscape(res.NextCursor)); w.Code != http.StatusOK {
+		t.Errorf("expected the cursor to be accepted with its own sort, got %d: %s", w.Code, w.Body)
+	}
+}
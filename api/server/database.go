@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/yanchenm/photo-sync/config"
+	"github.com/yanchenm/photo-sync/db"
+)
+
+// OpenDatabase connects to the database described by the configuration
+func OpenDatabase(cfg config.Database) (db.Database, error) {
+	return db.Initialize(db.Config{
+		Driver:          db.Dialect(cfg.Driver),
+		DSN:             cfg.URL,
+		Host:            cfg.Host,
+		Port:            cfg.Port,
+		User:            cfg.User,
+		Password:        cfg.Password,
+		Name:            cfg.Name,
+		SSLMode:         cfg.SSLMode,
+		SSLRootCert:     cfg.SSLRootCert,
+		SQLitePath:      cfg.SQLitePath,
+		MaxOpenConns:    cfg.MaxOpenConns,
+		MaxIdleConns:    cfg.MaxIdleConns,
+		ConnMaxLifetime: cfg.ConnMaxLifetime,
+		QueryTimeout:    cfg.QueryTimeout,
+	})
+}
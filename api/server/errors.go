@@ -1 +1,93 @@
 package server
+
+import (
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yanchenm/photo-sync/db"
+)
+
+// STATUS_CLIENT_CLOSED_REQUEST reports a request the client gave up on before it was handled. The client never sees
+// it, but it keeps the request out of the server failures in logs, metrics and traces.
+const STATUS_CLIENT_CLOSED_REQUEST = 499
+
+// errorStatus maps an error returned by the database to the HTTP status it should be reported with
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, db.ErrCanceled):
+		return STATUS_CLIENT_CLOSED_REQUEST
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// httpError is a failure along with the status and message it is reported to the client with. It is returned by
+// work that is shared between handlers rather than written as a response straight away.
+type httpError struct {
+	status  int
+	message string
+	err     error
+}
+
+func (e *httpError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// logHTTPError logs the error behind a failure, if there is one, against the request's logger and span
+func logHTTPError(r *http.Request, err *httpError) {
+	if err.err == nil {
+		return
+	}
+
+	// A client that went away isn't a failure of the server
+	if errors.Is(err.err, db.ErrCanceled) {
+		logger(r).WithField("status", err.status).WithError(err.err).Info(err.message)
+		return
+	}
+
+	trace.SpanFromContext(r.Context()).RecordError(err.err)
+	logger(r).WithField("status", err.status).WithError(err.err).Error(err.message)
+}
+
+func respondWithHTTPError(w http.ResponseWriter, r *http.Request, err *httpError) {
+	logHTTPError(r, err)
+	respondWithError(w, r, err.status, err.message)
+}
+
+// dbError describes a database error with its status. Missing and conflicting records are reported in terms of
+// resource, while message describes any other failure.
+func dbError(err error, resource, message string) *httpError {
+	switch status := errorStatus(err); status {
+	case http.StatusNotFound:
+		return &httpError{status, resource + " does not exist", err}
+	case http.StatusConflict:
+		return &httpError{status, resource + " already exists", err}
+	case http.StatusGatewayTimeout:
+		return &httpError{status, "the database took too long to respond", err}
+	case STATUS_CLIENT_CLOSED_REQUEST:
+		return &httpError{status, "request was canceled", err}
+	default:
+		return &httpError{status, message, err}
+	}
+}
+
+// respondWithDBError logs a database error and responds with its status, as described by dbError
+func respondWithDBError(w http.ResponseWriter, r *http.Request, err error, resource, message string) {
+	respondWithHTTPError(w, r, dbError(err, resource, message))
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanceledRequestIsNotServerError(t *testing.T) {
+	s := newTestServer(t)
+	user, token := addTestUser(t, s, "owner@example.com")
+	addTestPhoto(t, s, user, "2DqDp0tWqTnXKyTA8IwkJzDxW01")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest(http.MethodGet, "/photos/2DqDp0tWqTnXKyTA8IwkJzDxW01", nil).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	if w := serve(s, r); w.Code != STATUS_CLIENT_CLOSED_REQUEST {
+		t.Errorf("expected status %d, got %d: %s", STATUS_CLIENT_CLOSED_REQUEST, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// readExif fills in the capture metadata of detail from the EXIF data in r. Missing or malformed tags are skipped,
+// since most images only carry some of them and many carry none at all.
+func readExif(r io.Reader, detail *models.Detail) error {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return err
+	}
+
+	if taken, err := x.DateTime(); err == nil {
+		detail.Taken = &taken
+	}
+
+	detail.CameraMake = exifString(x, exif.Make)
+	detail.CameraModel = exifString(x, exif.Model)
+	detail.Lens = exifString(x, exif.LensModel)
+
+	if focalLength, ok := exifFloat(x, exif.FocalLength); ok {
+		detail.FocalLength = focalLength
+	}
+
+	if aperture, ok := exifFloat(x, exif.FNumber); ok {
+		detail.Aperture = aperture
+	}
+
+	if tag, err := x.Get(exif.ExposureTime); err == nil {
+		if num, den, err := tag.Rat2(0); err == nil && num > 0 && den > 0 {
+			detail.ShutterSpeed = formatShutterSpeed(num, den)
+		}
+	}
+
+	if tag, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := tag.Int(0); err == nil {
+			detail.ISO = iso
+		}
+	}
+
+	if lat, long, err := x.LatLong(); err == nil && !math.IsNaN(lat) && !math.IsNaN(long) {
+		detail.Latitude = &lat
+		detail.Longitude = &long
+	}
+
+	return nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+
+	val, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.Trim(val, "\x00"))
+}
+
+func exifFloat(x *exif.Exif, name exif.FieldName) (float64, bool) {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0, false
+	}
+
+	rat, err := tag.Rat(0)
+	if err != nil {
+		return 0, false
+	}
+
+	val, _ := rat.Float64()
+	return val, true
+}
+
+// formatShutterSpeed formats an exposure time the way cameras display it, e.g. 1/250 or 2.5
+func formatShutterSpeed(num, den int64) string {
+	if num < den {
+		return fmt.Sprintf("1/%d", int64(math.Round(float64(den)/float64(num))))
+	}
+
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(num)/float64(den)), ".0")
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// READY_TIMEOUT bounds each readiness check so that a hung dependency fails the probe instead of stalling it
+const READY_TIMEOUT = 2 * time.Second
+
+// Commit and BuildTime describe the build and are set with
+// -ldflags "-X github.com/yanchenm/photo-sync/server.Commit=<sha> -X github.com/yanchenm/photo-sync/server.BuildTime=<time>".
+// When they aren't set, the commit and commit time recorded by the Go toolchain are reported instead.
+var (
+	Commit    string
+	BuildTime string
+)
+
+type ReadyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+type VersionResponse struct {
+	Commit              string `json:"commit"`
+	BuildTime           string `json:"build_time"`
+	GoVersion           string `json:"go_version"`
+	SchemaVersion       int    `json:"schema_version"`
+	LatestSchemaVersion int    `json:"latest_schema_version"`
+}
+
+// handleHealthz reports that the process is up and serving requests, without checking its dependencies
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the database and storage can be reached, so that traffic is only sent to
+// instances that can serve it
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]func(context.Context) error{
+		"database": s.DB.Ping,
+		"storage":  s.Storage.Ping,
+	}
+
+	res := ReadyResponse{Status: "ok", Checks: make(map[string]string)}
+	status := http.StatusOK
+
+	for name, check := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), READY_TIMEOUT)
+		err := check(ctx)
+		cancel()
+
+		if err != nil {
+			logger(r).WithError(err).WithField("check", name).Error("readiness check failed")
+			// The endpoint is public, so the details are only logged
+			res.Checks[name] = "unavailable"
+			res.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+
+		res.Checks[name] = "ok"
+	}
+
+	respondWithJSON(w, status, res)
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	commit, buildTime := buildInfo()
+	res := VersionResponse{
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	var err error
+	if res.LatestSchemaVersion, err = s.DB.LatestSchemaVersion(); err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to read bundled migrations", err)
+		return
+	}
+
+	if res.SchemaVersion, err = s.DB.SchemaVersion(r.Context()); err != nil {
+		respondWithDBError(w, r, err, "schema version", "failed to get schema version")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func buildInfo() (commit, buildTime string) {
+	commit, buildTime = Commit, BuildTime
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && commit == "":
+				commit = setting.Value
+			case setting.Key == "vcs.time" && buildTime == "":
+				buildTime = setting.Value
+			}
+		}
+	}
+
+	if commit == "" {
+		commit = "unknown"
+	}
+
+	if buildTime == "" {
+		buildTime = "unknown"
+	}
+
+	return commit, buildTime
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+	// IDEMPOTENCY_REPLAYED_HEADER marks a response that returns the photo created by an earlier upload with the
+	// same idempotency key
+	IDEMPOTENCY_REPLAYED_HEADER = "Idempotent-Replayed"
+
+	// IDEMPOTENCY_KEY_EXPIRY is how long an upload can be retried with the same idempotency key
+	IDEMPOTENCY_KEY_EXPIRY = 24 * time.Hour
+
+	MAX_IDEMPOTENCY_KEY_LEN = 255
+
+	// ON_DUPLICATE_RETURN and ON_DUPLICATE_REJECT are the values of the on_duplicate query parameter, which says
+	// whether uploading a photo that has already been uploaded returns the existing photo or fails with a conflict
+	ON_DUPLICATE_RETURN = "return"
+	ON_DUPLICATE_REJECT = "reject"
+)
+
+// parseOnDuplicate reads what to do with a photo that has already been uploaded. The query string is read directly
+// so that the multipart body isn't parsed before it can be streamed.
+func parseOnDuplicate(r *http.Request) (string, error) {
+	switch onDuplicate := r.URL.Query().Get("on_duplicate"); onDuplicate {
+	case "", ON_DUPLICATE_RETURN:
+		return ON_DUPLICATE_RETURN, nil
+	case ON_DUPLICATE_REJECT:
+		return ON_DUPLICATE_REJECT, nil
+	default:
+		return "", fmt.Errorf("unknown on_duplicate %q", onDuplicate)
+	}
+}
+
+// duplicateError describes a photo that was rejected because the user has already uploaded it
+func duplicateError(existing models.Photo) *httpError {
+	return &httpError{status: http.StatusConflict, message: "photo has already been uploaded as " + existing.ID}
+}
+
+// idempotencyKey reads the idempotency key sent with an upload, if any
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IDEMPOTENCY_KEY_HEADER)
+	if len(key) > MAX_IDEMPOTENCY_KEY_LEN {
+		return "", fmt.Errorf("%s must be at most %d characters", IDEMPOTENCY_KEY_HEADER, MAX_IDEMPOTENCY_KEY_LEN)
+	}
+
+	return key, nil
+}
+
+// replayUpload responds with the photo created by an earlier upload with the same idempotency key, if there was
+// one, and reports whether it responded
+func (s *Server) replayUpload(w http.ResponseWriter, r *http.Request, user models.User, key string) bool {
+	photoId, err := s.DB.GetIdempotentPhoto(r.Context(), user.Email, key, time.Now())
+	if errors.Is(err, db.ErrNotFound) {
+		return false
+	} else if err != nil {
+		respondWithDBError(w, r, err, "idempotency key", "failed to check idempotency key")
+		return true
+	}
+
+	addLogFields(r, log.Fields{"photo_id": photoId, "idempotent_replay": true})
+
+	photo, err := s.DB.GetPhotoWithDetail(r.Context(), photoId)
+	if err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to get photo")
+		return true
+	}
+
+	w.Header().Set(IDEMPOTENCY_REPLAYED_HEADER, "true")
+	respondWithJSON(w, http.StatusOK, photo)
+	return true
+}
+
+// recordUpload remembers the photo created by an upload with an idempotency key. If another upload with the same
+// key finished first, its photo is returned instead and the one created by this upload is deleted.
+func (s *Server) recordUpload(r *http.Request, user models.User, key string, photo models.Photo, duplicate bool) (models.Photo, *httpError) {
+	err := s.DB.AddIdempotencyKey(r.Context(), user.Email, key, photo.ID, time.Now().Add(IDEMPOTENCY_KEY_EXPIRY))
+	if err == nil {
+		return photo, nil
+	}
+
+	if !errors.Is(err, db.ErrConflict) {
+		// The photo was still created, and retrying the upload finds it by its content instead
+		logger(r).WithError(err).Warn("failed to record idempotency key")
+		return photo, nil
+	}
+
+	photoId, err := s.DB.GetIdempotentPhoto(r.Context(), user.Email, key, time.Now())
+	if err != nil {
+		return photo, dbError(err, "idempotency key", "failed to check idempotency key")
+	}
+
+	if photoId == photo.ID {
+		return photo, nil
+	}
+
+	winner, err := s.DB.GetPhotoWithDetail(r.Context(), photoId)
+	if err != nil {
+		return photo, dbError(err, "photo", "failed to get photo")
+	}
+
+	if !duplicate {
+		s.discardPhoto(r, photo)
+	}
+
+	return winner, nil
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+const LINK_PASSWORD_HEADER = "X-Link-Password"
+
+type ShareLinkRequest struct {
+	Photos        []string   `json:"photos"`
+	Password      string     `json:"password"`
+	AllowDownload bool       `json:"allow_download"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+}
+
+type PublicLinkResponse struct {
+	Items         models.PhotoList `json:"items"`
+	AllowDownload bool             `json:"allow_download"`
+	ExpiresAt     *time.Time       `json:"expires_at"`
+}
+
+func generateLinkToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func (s *Server) handleCreateShareLink(w http.ResponseWriter, r *http.Request, user models.User) {
+	req := ShareLinkRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request payload", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if len(req.Photos) == 0 {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("[photos]"))
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondWithError(w, r, http.StatusBadRequest, "expiry must be in the future")
+		return
+	}
+
+	// Drop duplicates so each photo appears once in the link
+	seen := make(map[string]bool)
+	var photos []string
+	for _, id := range req.Photos {
+		if !seen[id] {
+			seen[id] = true
+			photos = append(photos, id)
+		}
+	}
+
+	if !s.checkPhotosOwned(w, r, photos, user) {
+		return
+	}
+
+	token, err := generateLinkToken()
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to generate link", err)
+		return
+	}
+
+	link := models.ShareLink{
+		Token:         token,
+		User:          user.Email,
+		Password:      req.Password,
+		AllowDownload: req.AllowDownload,
+		ExpiresAt:     req.ExpiresAt,
+		Photos:        photos,
+	}
+
+	if err := link.HashPassword(); err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to process password", err)
+		return
+	}
+
+	if err := s.DB.AddShareLink(r.Context(), &link); err != nil {
+		respondWithDBError(w, r, err, "link", "failed to create link")
+		return
+	}
+
+	link.BeforeSend()
+	respondWithJSON(w, http.StatusCreated, link)
+}
+
+func (s *Server) handleGetShareLinks(w http.ResponseWriter, r *http.Request, user models.User) {
+	links, err := s.DB.GetShareLinks(r.Context(), user)
+	if err != nil {
+		respondWithDBError(w, r, err, "link", "failed to get links from database")
+		return
+	}
+
+	for i := range links {
+		links[i].BeforeSend()
+	}
+
+	respondWithJSON(w, http.StatusOK, links)
+}
+
+func (s *Server) handleRevokeShareLink(w http.ResponseWriter, r *http.Request, user models.User) {
+	params := mux.Vars(r)
+	token := params["token"]
+
+	link, err := s.DB.GetShareLink(r.Context(), token)
+	if err != nil {
+		respondWithDBError(w, r, err, "link", "failed to get link")
+		return
+	}
+
+	if link.User != user.Email {
+		respondWithError(w, r, http.StatusForbidden, "you don't have permission to revoke this link")
+		return
+	}
+
+	if err := s.DB.DeleteShareLink(r.Context(), token); err != nil {
+		respondWithDBError(w, r, err, "link", "failed to revoke link")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleGetPublicLink resolves a share link for anyone who has it, including people without an account
+func (s *Server) handleGetPublicLink(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	token := params["token"]
+
+	link, err := s.DB.GetShareLink(r.Context(), token)
+	if err != nil {
+		respondWithDBError(w, r, err, "link", "failed to get link")
+		return
+	}
+
+	if link.Expired() {
+		respondWithError(w, r, http.StatusNotFound, "link does not exist or has expired")
+		return
+	}
+
+	if !link.VerifyPassword(r.Header.Get(LINK_PASSWORD_HEADER)) {
+		respondWithError(w, r, http.StatusUnauthorized, "incorrect or missing link password")
+		return
+	}
+
+	photos, err := s.DB.GetShareLinkPhotos(r.Context(), token)
+	if err != nil {
+		respondWithDBError(w, r, err, "link", "failed to get photos from database")
+		return
+	}
+
+	allowDownload := func(models.Photo) bool { return link.AllowDownload }
+	if !s.populatePhotoList(w, r, photos, allowDownload) {
+		return
+	}
+
+	// Don't reveal anything about the owner, where the photos were taken or the storage layout to the public
+	for i := range photos.Photos {
+		photos.Photos[i].User = ""
+		photos.Photos[i].Key = ""
+		photos.Photos[i].Thumbnail = ""
+		photos.Photos[i].Details = publicDetail(photos.Photos[i].Details)
+	}
+
+	respondWithJSON(w, http.StatusOK, PublicLinkResponse{
+		Items:         *photos,
+		AllowDownload: link.AllowDownload,
+		ExpiresAt:     link.ExpiresAt,
+	})
+}
+
+// publicDetail keeps only the details of a photo that are safe to show to anyone with a link, leaving out its
+// location, the camera it was taken with and the digest of the original
+func publicDetail(detail models.Detail) models.Detail {
+	return models.Detail{
+		ID:       detail.ID,
+		FileType: detail.FileType,
+		Height:   detail.Height,
+		Width:    detail.Width,
+		Size:     detail.Size,
+		Taken:    detail.Taken,
+	}
+}
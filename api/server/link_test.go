@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+func TestPublicLinkHidesLocation(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	user, _ := addTestUser(t, s, "owner@example.com")
+
+	latitude, longitude := 43.6532, -79.3832
+	photo := addTestPhoto(t, s, user, "2Dq4xNqvqgkIjS8ekmNuR1fcgSs", func(photo *models.Photo) {
+		photo.Details.Height = 800
+		photo.Details.Width = 1200
+		photo.Details.CameraMake = "Canon"
+		photo.Details.CameraModel = "EOS R5"
+		photo.Details.Latitude = &latitude
+		photo.Details.Longitude = &longitude
+		photo.Details.SHA256 = strings.Repeat("ab", 32)
+	})
+
+	link := models.ShareLink{Token: "public-token", User: user.Email, AllowDownload: true, Photos: []string{photo.ID}}
+	if err := s.DB.AddShareLink(ctx, &link); err != nil {
+		t.Fatalf("failed to add link: %s", err)
+	}
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/public/"+link.Token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	body := w.Body.String()
+	for _, secret := range []string{"43.6532", "-79.3832", "Canon", "EOS R5", photo.Details.SHA256, user.Email} {
+		if strings.Contains(body, secret) {
+			t.Errorf("public link response contains %q: %s", secret, body)
+		}
+	}
+
+	response := PublicLinkResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	if len(response.Items.Photos) != 1 {
+		t.Fatalf("expected 1 photo, got %d", len(response.Items.Photos))
+	}
+
+	detail := response.Items.Photos[0].Details
+	if detail.Latitude != nil || detail.Longitude != nil {
+		t.Errorf("expected no location, got %v, %v", detail.Latitude, detail.Longitude)
+	}
+
+	if detail.Width != 1200 || detail.Height != 800 {
+		t.Errorf("expected dimensions to be kept, got %dx%d", detail.Width, detail.Height)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yanchenm/photo-sync/config"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+	MAX_REQUEST_ID    = 128
+)
+
+type contextKey int
+
+const requestLogKey contextKey = iota
+
+// requestLog is the logger for a single request. It is shared by pointer so that fields added deeper in the
+// handler chain, such as the authenticated user, also appear on the access log line written at the end.
+type requestLog struct {
+	id    string
+	entry *log.Entry
+}
+
+// ConfigureLogging sets the format and level of the standard logger
+func ConfigureLogging(cfg config.Logging) error {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(level)
+
+	if cfg.Format == "text" {
+		log.SetFormatter(&log.TextFormatter{})
+	} else {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+
+	return nil
+}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	if l, ok := ctx.Value(requestLogKey).(*requestLog); ok {
+		return l
+	}
+
+	return nil
+}
+
+// logger returns the logger for the request, which carries its request id, route and user
+func logger(r *http.Request) *log.Entry {
+	if l := requestLogFrom(r.Context()); l != nil {
+		return l.entry
+	}
+
+	return log.NewEntry(log.StandardLogger())
+}
+
+// addLogFields attaches fields to every later log line for the request
+func addLogFields(r *http.Request, fields log.Fields) {
+	if l := requestLogFrom(r.Context()); l != nil {
+		l.entry = l.entry.WithFields(fields)
+	}
+}
+
+func requestID(r *http.Request) string {
+	if l := requestLogFrom(r.Context()); l != nil {
+		return l.id
+	}
+
+	return ""
+}
+
+// validRequestID accepts ids from clients and proxies as long as they can't be used to forge log lines or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID {
+		return false
+	}
+
+	return strings.IndexFunc(id, func(c rune) bool { return c <= ' ' || c > '~' }) < 0
+}
+
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return "unknown"
+}
+
+// routeFields names the ids in the request path for logging. Link tokens grant access to photos, so they are
+// deliberately left out.
+func routeFields(route string, vars map[string]string) log.Fields {
+	fields := log.Fields{}
+
+	if id, ok := vars["id"]; ok {
+		switch {
+		case strings.HasPrefix(route, "/photos/"):
+			fields["photo_id"] = id
+		case strings.HasPrefix(route, "/albums/"):
+			fields["album_id"] = id
+		case strings.HasPrefix(route, "/uploads/"):
+			fields["upload_id"] = id
+		case strings.HasPrefix(route, "/upload-slots/"):
+			fields["slot_id"] = id
+		}
+	}
+
+	if photoId, ok := vars["photoId"]; ok {
+		fields["photo_id"] = photoId
+	}
+
+	return fields
+}
+
+// logRequests is router middleware that assigns each request an id, or keeps the one given by the client or a
+// proxy, and writes a structured access log line once the request has been handled
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = ksuid.New().String()
+		}
+
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		route := routeTemplate(r)
+		fields := log.Fields{
+			"request_id": id,
+			"method":     r.Method,
+			"route":      route,
+		}
+
+		// Link the logs to the trace of the request when it is being recorded
+		if span := trace.SpanContextFromContext(r.Context()); span.IsSampled() {
+			fields["trace_id"] = span.TraceID().String()
+		}
+
+		l := &requestLog{
+			id:    id,
+			entry: log.WithFields(fields).WithFields(routeFields(route, mux.Vars(r))),
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestLogKey, l)))
+
+		l.entry.WithFields(log.Fields{
+			"status":      recorder.status,
+			"bytes":       recorder.bytes,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"remote_addr": r.RemoteAddr,
+		}).Info("request handled")
+	})
+}
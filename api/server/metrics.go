@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+// metrics holds the collectors for one server. Each server has its own registry so that several can be created
+// in the same process without clashing.
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	uploadSize      prometheus.Histogram
+	thumbnailTime   prometheus.Histogram
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+	tokenRotations  prometheus.Counter
+	failedLogins    *prometheus.CounterVec
+}
+
+func newMetrics(dbStats func() sql.DBStats) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "photosync_http_requests_total",
+			Help: "HTTP requests handled, by route and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "photosync_http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by route and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		uploadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "photosync_upload_size_bytes",
+			Help:    "Size of uploaded photos.",
+			Buckets: prometheus.ExponentialBuckets(64<<10, 2, 12),
+		}),
+		thumbnailTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "photosync_thumbnail_duration_seconds",
+			Help:    "Time taken to resize and encode the thumbnail of an uploaded photo.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "photosync_storage_operation_duration_seconds",
+			Help:    "Time taken by storage operations, by operation.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "photosync_storage_errors_total",
+			Help: "Storage operations that failed, by operation.",
+		}, []string{"operation"}),
+		tokenRotations: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "photosync_refresh_token_rotations_total",
+			Help: "Refresh tokens exchanged for a new pair of tokens.",
+		}),
+		failedLogins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "photosync_failed_logins_total",
+			Help: "Login attempts rejected, by reason.",
+		}, []string{"reason"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.requestDuration,
+		m.uploadSize,
+		m.thumbnailTime,
+		m.storageDuration,
+		m.storageErrors,
+		m.tokenRotations,
+		m.failedLogins,
+		newDBStatsCollector(dbStats),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// statusRecorder remembers the status and size of the response written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers keep working behind the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument is router middleware that counts and times requests. Routes are labelled by their template rather
+// than their path so that ids don't create a series per photo.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(recorder, r)
+
+		status := strconv.Itoa(recorder.status)
+		s.metrics.requests.WithLabelValues(r.Method, route, status).Inc()
+		s.metrics.requestDuration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// handleMetrics serves the metrics in the Prometheus text format. When a metrics token is configured, scrapers
+// must present it as a bearer token.
+func (s *Server) handleMetrics() http.Handler {
+	handler := promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := s.Config.MetricsToken; token != "" && !hasBearerToken(r, token) {
+			respondWithJSON(w, http.StatusUnauthorized, nil)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// hasBearerToken reports whether the request is authorized with token, comparing in constant time so that the
+// token can't be guessed from response times
+func hasBearerToken(r *http.Request, token string) bool {
+	given := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) == 1
+}
+
+// dbStatsCollector reports the connection pool statistics of the database
+type dbStatsCollector struct {
+	stats func() sql.DBStats
+
+	maxOpen      *prometheus.Desc
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+func newDBStatsCollector(stats func() sql.DBStats) *dbStatsCollector {
+	return &dbStatsCollector{
+		stats:        stats,
+		maxOpen:      prometheus.NewDesc("photosync_db_max_open_connections", "Maximum number of open connections to the database.", nil, nil),
+		open:         prometheus.NewDesc("photosync_db_open_connections", "Established connections to the database, both in use and idle.", nil, nil),
+		inUse:        prometheus.NewDesc("photosync_db_in_use_connections", "Connections to the database currently in use.", nil, nil),
+		idle:         prometheus.NewDesc("photosync_db_idle_connections", "Idle connections to the database.", nil, nil),
+		waitCount:    prometheus.NewDesc("photosync_db_wait_count_total", "Times a query had to wait for a free connection.", nil, nil),
+		waitDuration: prometheus.NewDesc("photosync_db_wait_duration_seconds_total", "Time spent waiting for a free connection.", nil, nil),
+	}
+}
+
+func (c *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpen
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waitCount
+	ch <- c.waitDuration
+}
+
+func (c *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.maxOpen, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+}
+
+// instrumentedStorage records the latency and failures of every operation on the storage it wraps, and traces
+// each one as a span
+type instrumentedStorage struct {
+	storage.Storage
+	metrics *metrics
+}
+
+// Unwrap returns the underlying backend, so that callers can still check which optional interfaces it implements
+func (i instrumentedStorage) Unwrap() storage.Storage {
+	return i.Storage
+}
+
+func (i instrumentedStorage) start(ctx context.Context, operation, key string) (context.Context, trace.Span, time.Time) {
+	ctx, span := tracer.Start(ctx, "storage."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	if key != "" {
+		span.SetAttributes(attribute.String("storage.key", key))
+	}
+
+	return ctx, span, time.Now()
+}
+
+// observe ends the span of an operation. Missing objects are an expected answer rather than a failure.
+func (i instrumentedStorage) observe(span trace.Span, operation string, start time.Time, err error) {
+	i.metrics.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		i.metrics.storageErrors.WithLabelValues(operation).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// countingReader counts the bytes read through it, so that the size of an upload is known once it has been stored
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (i instrumentedStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	ctx, span, start := i.start(ctx, "put", key)
+	counter := &countingReader{Reader: body}
+	err := i.Storage.Put(ctx, key, counter)
+	span.SetAttributes(attribute.Int64("storage.size", counter.n))
+	i.observe(span, "put", start, err)
+	return err
+}
+
+func (i instrumentedStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	ctx, span, start := i.start(ctx, "get", key)
+	body, err := i.Storage.Get(ctx, key)
+	i.observe(span, "get", start, err)
+	return body, err
+}
+
+func (i instrumentedStorage) Delete(ctx context.Context, key string) error {
+	ctx, span, start := i.start(ctx, "delete", key)
+	err := i.Storage.Delete(ctx, key)
+	i.observe(span, "delete", start, err)
+	return err
+}
+
+func (i instrumentedStorage) Stat(ctx context.Context, key string) (storage.ObjectInfo, error) {
+	ctx, span, start := i.start(ctx, "stat", key)
+	info, err := i.Storage.Stat(ctx, key)
+	span.SetAttributes(attribute.Int64("storage.size", info.Size))
+	i.observe(span, "stat", start, err)
+	return info, err
+}
+
+func (i instrumentedStorage) List(ctx context.Context, fn func(storage.ObjectInfo) error) error {
+	ctx, span, start := i.start(ctx, "list", "")
+	err := i.Storage.List(ctx, fn)
+	i.observe(span, "list", start, err)
+	return err
+}
+
+func (i instrumentedStorage) SignedURL(ctx context.Context, key, fileName string, expiry time.Duration) (string, error) {
+	ctx, span, start := i.start(ctx, "sign", key)
+	url, err := i.Storage.SignedURL(ctx, key, fileName, expiry)
+	i.observe(span, "sign", start, err)
+	return url, err
+}
+
+func (i instrumentedStorage) SignedUploadURL(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (storage.PresignedUpload, error) {
+	ctx, span, start := i.start(ctx, "sign_upload", key)
+	upload, err := i.Storage.SignedUploadURL(ctx, key, contentType, size, expiry)
+	i.observe(span, "sign_upload", start, err)
+	return upload, err
+}
+
+func (i instrumentedStorage) Ping(ctx context.Context) error {
+	ctx, span, start := i.start(ctx, "ping", "")
+	err := i.Storage.Ping(ctx)
+	i.observe(span, "ping", start, err)
+	return err
+}
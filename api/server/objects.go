@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// CLEANUP_TIMEOUT bounds storage cleanup that carries on after the client has gone away
+	CLEANUP_TIMEOUT = 30 * time.Second
+	PURGE_BATCH     = 100
+	PURGE_INTERVAL  = 10 * time.Minute
+)
+
+// detach returns a context for cleanup that must finish even if the request is cancelled. It keeps the span of
+// the request so that the cleanup still shows up in its trace.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)), CLEANUP_TIMEOUT)
+}
+
+// deleteObjects deletes objects from storage and returns the keys that are gone, along with the errors for any
+// that aren't
+func (s *Server) deleteObjects(ctx context.Context, keys []string) ([]string, error) {
+	var deleted []string
+	var errs []error
+
+	for _, key := range keys {
+		if err := s.Storage.Delete(ctx, key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+
+		deleted = append(deleted, key)
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+// discardObjects removes the objects written by a request that failed part way through. Any that can't be removed
+// now are queued for deletion so that they are retried rather than left behind.
+func (s *Server) discardObjects(r *http.Request, keys ...string) {
+	ctx, cancel := detach(r.Context())
+	defer cancel()
+
+	deleted, err := s.deleteObjects(ctx, keys)
+	if err == nil {
+		return
+	}
+
+	logger(r).WithError(err).Warn("failed to discard objects, queueing them for deletion")
+
+	remaining := make([]string, 0, len(keys)-len(deleted))
+	for _, key := range keys {
+		if !contains(deleted, key) {
+			remaining = append(remaining, key)
+		}
+	}
+
+	if err := s.DB.QueueObjectDeletions(ctx, remaining); err != nil {
+		logger(r).WithError(err).WithField("keys", remaining).Error("failed to queue objects for deletion")
+	}
+}
+
+// purgeObjects deletes queued objects from storage and takes them off the queue once they are gone. Objects that
+// couldn't be deleted stay queued.
+func (s *Server) purgeObjects(ctx context.Context, keys []string) (int, error) {
+	deleted, deleteErr := s.deleteObjects(ctx, keys)
+	if len(deleted) == 0 {
+		return 0, deleteErr
+	}
+
+	if err := s.DB.CompleteObjectDeletions(ctx, deleted); err != nil {
+		return 0, errors.Join(deleteErr, err)
+	}
+
+	return len(deleted), deleteErr
+}
+
+// PurgeDeletedObjects works through the queue of objects waiting to be deleted from storage and returns how many
+// were deleted. It stops early if a whole batch fails.
+func (s *Server) PurgeDeletedObjects(ctx context.Context) (int, error) {
+	total := 0
+
+	for {
+		keys, err := s.DB.GetObjectDeletions(ctx, PURGE_BATCH)
+		if err != nil {
+			return total, err
+		}
+
+		if len(keys) == 0 {
+			return total, nil
+		}
+
+		n, err := s.purgeObjects(ctx, keys)
+		total += n
+
+		if n == 0 || len(keys) < PURGE_BATCH {
+			return total, err
+		}
+	}
+}
+
+// expireUploads abandons unfinished uploads and upload slots that have expired, queueing what they staged in
+// storage for deletion, and returns how many were abandoned
+func (s *Server) expireUploads(ctx context.Context) (int, error) {
+	now := time.Now()
+
+	uploads, err := s.DB.DeleteExpiredUploads(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	slots, err := s.DB.DeleteExpiredUploadSlots(ctx, now)
+	return uploads + slots, err
+}
+
+// SweepResult counts what a sweep cleaned up
+type SweepResult struct {
+	ExpiredUploads         int
+	ExpiredIdempotencyKeys int
+	PurgedObjects          int
+}
+
+// Sweep abandons expired uploads, forgets expired idempotency keys and retries queued deletions. Every step is
+// attempted even if an earlier one fails. The standalone server sweeps in the background, while under Lambda a
+// scheduled event or `photo-sync admin sweep` has to run it.
+func (s *Server) Sweep(ctx context.Context) (SweepResult, error) {
+	result := SweepResult{}
+	var errs []error
+
+	expired, err := s.expireUploads(ctx)
+	result.ExpiredUploads = expired
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete expired uploads: %w", err))
+	}
+
+	keys, err := s.DB.DeleteExpiredIdempotencyKeys(ctx, time.Now())
+	result.ExpiredIdempotencyKeys = keys
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to delete expired idempotency keys: %w", err))
+	}
+
+	purged, err := s.PurgeDeletedObjects(ctx)
+	result.PurgedObjects = purged
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to purge deleted objects: %w", err))
+	}
+
+	return result, errors.Join(errs...)
+}
+
+// LogSweep logs what a sweep cleaned up and why it failed, if it did
+func LogSweep(result SweepResult, err error) {
+	if err != nil {
+		log.WithError(err).Error("storage sweep failed")
+	}
+
+	if result != (SweepResult{}) {
+		log.WithFields(log.Fields{
+			"expired_uploads":          result.ExpiredUploads,
+			"expired_idempotency_keys": result.ExpiredIdempotencyKeys,
+			"purged_objects":           result.PurgedObjects,
+		}).Info("swept storage")
+	}
+}
+
+// purgeLoop sweeps in the background until ctx is cancelled
+func (s *Server) purgeLoop(ctx context.Context) {
+	ticker := time.NewTicker(PURGE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		result, err := s.Sweep(ctx)
+		if ctx.Err() != nil {
+			err = nil
+		}
+
+		LogSweep(result, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
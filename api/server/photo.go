@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/gif"
@@ -9,63 +11,47 @@ import (
 	_ "image/png"
 	"io"
 	"math"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/disintegration/imageorient"
 	"github.com/gorilla/mux"
 	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/image/draw"
 
+	"github.com/yanchenm/photo-sync/db"
 	"github.com/yanchenm/photo-sync/models"
 )
 
 type GetPhotosResponse struct {
-	Items   models.PhotoList `json:"items"`
-	HasMore bool             `json:"has_more"`
-	Total   int              `json:"total"`
+	Items      models.PhotoList `json:"items"`
+	HasMore    bool             `json:"has_more"`
+	Total      int              `json:"total"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	PrevCursor string           `json:"prev_cursor,omitempty"`
 }
 
 const (
-	THUMBNAIL_MAX = 600
-)
-
-func uploadToS3(sess *session.Session, bucket, key string, file io.Reader) error {
-	uploader := s3manager.NewUploader(sess)
+	SIGNED_URL_EXPIRY = 15 * time.Minute
+	DEFAULT_PAGE_SIZE = 50
 
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   file,
-	})
-
-	return err
-}
+	// SNIFF_LEN is how much of an upload is read to work out what type of image it is
+	SNIFF_LEN = 512
 
-func generateSignedUrl(sess *session.Session, bucket, key, fileName string) (string, error) {
-	svc := s3.New(sess)
-
-	fileNameParam := fmt.Sprintf("attachment; filename=\"%s\"", fileName)
-	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket:                     aws.String(bucket),
-		Key:                        aws.String(key),
-		ResponseContentDisposition: aws.String(fileNameParam),
-	})
-
-	return req.Presign(15 * time.Minute)
-}
+	// FORM_ENVELOPE_SIZE is how much of an upload form is allowed on top of its photos, for the boundaries, part
+	// headers and any other fields. The photos themselves are held to the upload size limit as they are read.
+	FORM_ENVELOPE_SIZE = 1 << 20
+)
 
-func createThumbnail(src image.Image) image.Image {
+func createThumbnail(src image.Image, maxSize int) image.Image {
 	bounds := src.Bounds()
 	width, height := bounds.Dx(), bounds.Dy()
 
-	if width <= THUMBNAIL_MAX && height <= THUMBNAIL_MAX {
+	if width <= maxSize && height <= maxSize {
 		return src
 	}
 
@@ -74,11 +60,11 @@ func createThumbnail(src image.Image) image.Image {
 
 	if width > height {
 		aspect := float64(height) / float64(width)
-		thumbWidth = 600
+		thumbWidth = maxSize
 		thumbHeight = int(math.Max(1.0, math.Floor(float64(thumbWidth)*aspect)))
 	} else {
 		aspect := float64(width) / float64(height)
-		thumbHeight = 600
+		thumbHeight = maxSize
 		thumbWidth = int(math.Max(1.0, math.Floor(float64(thumbHeight)*aspect)))
 	}
 
@@ -89,127 +75,419 @@ func createThumbnail(src image.Image) image.Image {
 	return thumbnail
 }
 
+// encodeThumbnail creates the JPEG thumbnail stored alongside every photo
+func encodeThumbnail(src image.Image, maxSize int) (*bytes.Buffer, error) {
+	thumbnail := new(bytes.Buffer)
+	if err := jpeg.Encode(thumbnail, createThumbnail(src, maxSize), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+
+	return thumbnail, nil
+}
+
+// handleUploadPhoto streams the photo part of a multipart form straight through processing and into storage, so
+// that the upload is never held in memory. Retrying an upload with the same Idempotency-Key returns the photo
+// created the first time without reading the form again.
 func (s *Server) handleUploadPhoto(w http.ResponseWriter, r *http.Request, user models.User) {
-	photo := models.Photo{
-		User: user.Email,
+	onDuplicate, err := parseOnDuplicate(r)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid query parameters", err)
+		return
 	}
 
-	// Set max photo size to 10MB
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "failed to parse form", err)
+	key, err := idempotencyKey(r)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid idempotency key", err)
+		return
+	}
+
+	if key != "" && s.replayUpload(w, r, user, key) {
 		return
 	}
 
-	// Get photo from request body
-	file, header, err := r.FormFile("photo")
+	r.Body = http.MaxBytesReader(w, r.Body, s.Config.Upload.MaxSize+FORM_ENVELOPE_SIZE)
+	form, err := r.MultipartReader()
 	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid file upload", err)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "failed to parse form", err)
 		return
 	}
 
-	fileName := header.Filename
-	photo.Filename = fileName
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			respondWithError(w, r, http.StatusBadRequest, "invalid file upload")
+			return
+		} else if err != nil {
+			respondWithHTTPError(w, r, s.readError("failed to parse form", err))
+			return
+		}
+
+		if !isPhotoPart(part) {
+			part.Close()
+			continue
+		}
+
+		photo, duplicate, saveErr := s.savePhoto(r, user, part.FileName(), part)
+		part.Close()
+
+		// Further photos would otherwise be dropped without the client knowing, so the photo is only kept if it
+		// was the only one in the form
+		if saveErr == nil {
+			if saveErr = s.onlyPhoto(form); saveErr != nil && !duplicate {
+				s.discardPhoto(r, photo)
+			}
+		}
+
+		switch {
+		case saveErr != nil:
+		case duplicate && onDuplicate == ON_DUPLICATE_REJECT:
+			saveErr = duplicateError(photo)
+		case key != "":
+			photo, saveErr = s.recordUpload(r, user, key, photo, duplicate)
+		}
+
+		if saveErr != nil {
+			respondWithHTTPError(w, r, saveErr)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, photo)
+		return
+	}
+}
+
+// onlyPhoto reads the rest of an upload form, which fails if the form holds another photo
+func (s *Server) onlyPhoto(form *multipart.Reader) *httpError {
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return s.readError("failed to parse form", err)
+		}
+
+		isPhoto := isPhotoPart(part)
+		part.Close()
+
+		if isPhoto {
+			return &httpError{status: http.StatusBadRequest, message: "only one photo can be uploaded at a time, use /photos/batch to upload several"}
+		}
+	}
+}
+
+// discardPhoto deletes a photo that was created but can't be kept, along with its objects in storage
+func (s *Server) discardPhoto(r *http.Request, photo models.Photo) {
+	ctx, cancel := detach(r.Context())
+	defer cancel()
+
+	if err := s.DB.DeletePhoto(ctx, photo); err != nil {
+		logger(r).WithError(err).Error("failed to delete discarded photo")
+	} else if _, err := s.purgeObjects(ctx, []string{photo.Key, photo.Thumbnail}); err != nil {
+		logger(r).WithError(err).Warn("failed to delete discarded photo from storage, it will be retried")
+	}
+}
+
+// isPhotoPart reports whether a part of an upload form is a photo
+func isPhotoPart(part *multipart.Part) bool {
+	return part.FormName() == "photo" && part.FileName() != ""
+}
+
+// readError describes an upload that couldn't be read. That is the client's fault, and may be because the upload
+// was over the limit, unless the upload was being read back from storage.
+func (s *Server) readError(message string, err error) *httpError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return s.tooLargeError(err)
+	}
+
+	var storageErr storageReadError
+	if errors.As(err, &storageErr) {
+		return &httpError{http.StatusInternalServerError, message, err}
+	}
+
+	return &httpError{http.StatusBadRequest, message, err}
+}
+
+// tooLargeError describes a photo that is over the size limit
+func (s *Server) tooLargeError(err error) *httpError {
+	return &httpError{http.StatusRequestEntityTooLarge, fmt.Sprintf("photo is too large, the limit is %d bytes", s.Config.Upload.MaxSize), err}
+}
+
+// savePhoto creates a photo from an uploaded file, streaming the file into storage as it is read
+func (s *Server) savePhoto(r *http.Request, user models.User, fileName string, body io.Reader) (models.Photo, bool, *httpError) {
+	return s.createPhoto(r, user, fileName, body, "")
+}
+
+// saveStoredPhoto creates a photo from a file that is already in storage, which the photo keeps as its original.
+// The file is only read, and is left in storage even if the photo can't be created.
+func (s *Server) saveStoredPhoto(r *http.Request, user models.User, fileName, key string) (models.Photo, bool, *httpError) {
+	object := &objectsReader{s: s, ctx: r.Context(), keys: []string{key}}
+	defer object.Close()
+
+	return s.createPhoto(r, user, fileName, object, key)
+}
+
+// createPhoto creates a photo from a file, which is shared by every way of uploading a photo. The file is read
+// once: it is streamed to storage, unless it is already stored under the key stored, while a single pass decodes it
+// and hashes it, and only the start of the file is kept for reading EXIF data. Anything written to storage is
+// removed again if the photo can't be created.
+//
+// If the user has already uploaded the same file, no new photo is created. The existing photo is returned instead
+// and duplicate is true, leaving the caller to decide whether that is an error.
+func (s *Server) createPhoto(r *http.Request, user models.User, fileName string, body io.Reader, stored string) (photo models.Photo, duplicate bool, saveErr *httpError) {
+	photo = models.Photo{
+		User:     user.Email,
+		Filename: fileName,
+	}
 
 	// Generate unique ID for photo
 	id := ksuid.New().String()
 	photo.ID = id
+	addLogFields(r, log.Fields{"photo_id": id})
+	addSpanAttributes(r, attribute.String("photo_id", id))
 
-	// Read image upload into buffer
-	buffer := new(bytes.Buffer)
-	size, err := buffer.ReadFrom(file)
-	file.Close()
-	fileBuffer := buffer.Bytes()
+	stream := newPhotoStream(body, s.Config.Upload.MaxSize)
 
-	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid image file", err)
-		return
+	// The key depends on the type of photo, which is sniffed before anything is written to storage
+	sniffer := bufio.NewReaderSize(stream, SNIFF_LEN)
+	header, err := sniffer.Peek(SNIFF_LEN)
+	if stream.tooLarge {
+		return photo, false, s.tooLargeError(err)
+	} else if err != nil && err != io.EOF {
+		return photo, false, s.readError("failed to read photo", err)
 	}
 
-	// Open image
-	img, fileType, err := imageorient.Decode(bytes.NewReader(fileBuffer))
-	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid image file", err)
-		return
+	fileType, ok := photoTypes[http.DetectContentType(header)]
+	if !ok {
+		return photo, false, &httpError{status: http.StatusBadRequest, message: "invalid image file"}
+	}
+
+	photo.Key = id + "." + fileType
+	photo.Thumbnail = id + "_thumb.jpeg"
+
+	// Objects written here, which are removed again if a later step fails
+	written := []string{photo.Key}
+	if stored != "" {
+		photo.Key = stored
+		written = nil
+	}
+
+	// Decode the photo as it streams into storage, then read whatever the decoder didn't need so that all of it is
+	// stored and hashed
+	_, decodeSpan := tracer.Start(r.Context(), "upload.decode")
+	var upload *uploadWriter
+	var original io.Writer = io.Discard
+	if stored == "" {
+		upload = s.startUpload(r.Context(), photo.Key)
+		original = upload
+	}
+
+	tee := io.TeeReader(sniffer, original)
+
+	img, _, err := imageorient.Decode(tee)
+	if err == nil {
+		_, err = io.Copy(io.Discard, tee)
 	}
 
-	// Get photo details
-	config, _, err := imageorient.DecodeConfig(bytes.NewReader(fileBuffer))
 	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid image file", err)
-		return
+		decodeSpan.End()
+		if upload != nil {
+			upload.Abort(err)
+		}
+
+		switch {
+		case stream.tooLarge:
+			return photo, false, s.tooLargeError(err)
+		case upload != nil && upload.err != nil:
+			return photo, false, &httpError{http.StatusInternalServerError, "failed to upload photo", upload.err}
+		case stream.err != nil:
+			return photo, false, s.readError("failed to read photo", stream.err)
+		default:
+			return photo, false, &httpError{http.StatusBadRequest, "invalid image file", err}
+		}
 	}
 
-	detail := models.Detail{
+	bounds := img.Bounds()
+	decodeSpan.SetAttributes(
+		attribute.Int64("photo.size", stream.size),
+		attribute.String("photo.type", fileType),
+		attribute.Int("photo.width", bounds.Dx()),
+		attribute.Int("photo.height", bounds.Dy()),
+		attribute.String("photo.sha256", stream.Sum()),
+	)
+	decodeSpan.End()
+
+	if upload != nil {
+		if err := upload.Close(); err != nil {
+			return photo, false, &httpError{http.StatusInternalServerError, "failed to upload photo", err}
+		}
+	}
+
+	s.metrics.uploadSize.Observe(float64(stream.size))
+
+	// Uploading the same file again, such as when a client retries after a timeout, shouldn't store another copy.
+	// Uploads of the same file that overlap are caught when the photo is added instead.
+	sum := stream.Sum()
+	if existing, duplicate, err := s.existingPhoto(r, user, sum); duplicate || err != nil {
+		s.discardObjects(r, written...)
+		return existing, duplicate, err
+	}
+
+	photo.Details = models.Detail{
 		ID:       id,
 		FileType: fileType,
-		Height:   config.Height,
-		Width:    config.Width,
-		Size:     float32(size) / float32(1024*1024),
+		Height:   bounds.Dy(),
+		Width:    bounds.Dx(),
+		Size:     float32(stream.size) / float32(1024*1024),
+		SHA256:   sum,
 	}
 
-	// Create a thumbnail to display on main page
-	thumbnail := createThumbnail(img)
-	pr, pw := io.Pipe()
+	// Capture metadata is optional, so a photo without EXIF data is still accepted
+	if err := readExif(bytes.NewReader(stream.prefix), &photo.Details); err != nil {
+		logger(r).WithError(err).Debug("no exif data for photo")
+	}
 
-	// Spawn new goroutine to write to pipe - otherwise will block indefinitely
-	go func() {
-		jpeg.Encode(pw, thumbnail, &jpeg.Options{Quality: 90})
-		pw.Close()
-	}()
+	// Create a thumbnail to display on main page
+	_, thumbnailSpan := tracer.Start(r.Context(), "upload.thumbnail")
+	thumbnailStart := time.Now()
+	thumbnail, err := encodeThumbnail(img, s.Config.Upload.ThumbnailSize)
+	s.metrics.thumbnailTime.Observe(time.Since(thumbnailStart).Seconds())
 
-	// Upload image and thumbnail to S3
-	sess, err := getNewAWSSession(os.Getenv("AWS_REGION"))
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to initialize AWS session", err)
-		return
+		thumbnailSpan.End()
+		s.discardObjects(r, written...)
+		return photo, false, &httpError{http.StatusInternalServerError, "failed to create thumbnail", err}
 	}
 
-	err = uploadToS3(sess, os.Getenv("S3_BUCKET"), id+"."+fileType, bytes.NewReader(fileBuffer))
+	thumbnailSpan.SetAttributes(attribute.Int("thumbnail.size", thumbnail.Len()))
+	thumbnailSpan.End()
+
+	// Remove whatever was written to storage if a later step fails, so that storage never holds objects the
+	// database doesn't know about
+	err = s.Storage.Put(r.Context(), photo.Thumbnail, thumbnail)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to upload to S3", err)
-		return
+		s.discardObjects(r, written...)
+		return photo, false, &httpError{http.StatusInternalServerError, "failed to upload thumbnail", err}
 	}
 
-	err = uploadToS3(sess, os.Getenv("S3_BUCKET"), id+"_thumb.jpeg", pr)
-	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to upload to S3", err)
-		return
+	written = append(written, photo.Thumbnail)
+
+	err = s.DB.AddPhoto(r.Context(), &photo)
+	if errors.Is(err, db.ErrDuplicatePhoto) {
+		// The same file was uploaded at the same time by another request, which got there first
+		s.discardObjects(r, written...)
+		return s.existingPhoto(r, user, sum)
+	} else if err != nil {
+		s.discardObjects(r, written...)
+		return photo, false, dbError(err, "photo", "failed to add photo to database")
 	}
 
-	photo.Key = id + "." + fileType
-	photo.Thumbnail = id + "_thumb.jpeg"
+	return photo, false, nil
+}
 
-	if err := s.DB.AddPhoto(&photo); err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to add photo to database", err)
-		return
+// existingPhoto returns the photo the user has already uploaded with the same content, if there is one
+func (s *Server) existingPhoto(r *http.Request, user models.User, sha256 string) (models.Photo, bool, *httpError) {
+	existing, err := s.DB.GetPhotoByHash(r.Context(), user.Email, sha256)
+	if errors.Is(err, db.ErrNotFound) {
+		return existing, false, nil
+	} else if err != nil {
+		return existing, false, dbError(err, "photo", "failed to check for duplicate photos")
 	}
 
-	photo.Details = detail
+	addLogFields(r, log.Fields{"duplicate_of": existing.ID})
+	return existing, true, nil
+}
 
-	if err := s.DB.AddDetail(&detail); err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to add photo details to database", err)
-		return
+// parsePhotoFilter reads the sort order and date ranges of a photo listing from the query string. Dates may be
+// given as RFC 3339 timestamps or as plain dates, in which case the "to" bound includes the whole day.
+func parsePhotoFilter(r *http.Request) (db.PhotoFilter, error) {
+	filter := db.PhotoFilter{
+		Sort: r.FormValue("sort"),
 	}
-	respondWithJSON(w, http.StatusOK, photo)
+
+	if filter.Sort == "" {
+		filter.Sort = db.SortUploaded
+	} else if !db.ValidPhotoSort(filter.Sort) {
+		return filter, fmt.Errorf("unknown sort key %q", filter.Sort)
+	}
+
+	switch r.FormValue("order") {
+	case "", "desc":
+		filter.Ascending = false
+	case "asc":
+		filter.Ascending = true
+	default:
+		return filter, fmt.Errorf("unknown sort order %q", r.FormValue("order"))
+	}
+
+	var err error
+	bounds := []struct {
+		param string
+		end   bool
+		dest  *time.Time
+	}{
+		{"taken_from", false, &filter.TakenFrom},
+		{"taken_to", true, &filter.TakenTo},
+		{"uploaded_from", false, &filter.UploadedFrom},
+		{"uploaded_to", true, &filter.UploadedTo},
+	}
+
+	for _, bound := range bounds {
+		*bound.dest, err = parseDateParam(r.FormValue(bound.param), bound.end)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s: %s", bound.param, err)
+		}
+	}
+
+	return filter, nil
 }
 
-func (s *Server) handleGetPhotos(w http.ResponseWriter, r *http.Request, user models.User) {
-	res := GetPhotosResponse{}
+func parseDateParam(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return t, err
+	}
 
-	start, err := strconv.Atoi(r.FormValue("start"))
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// handleGetPhotos lists photos either by offset, when start is given, or by cursor. Cursor pages stay stable
+// while photos are added or removed and don't need to count every photo, so Total is only set in offset mode.
+func (s *Server) handleGetPhotos(w http.ResponseWriter, r *http.Request, user models.User) {
+	filter, err := parsePhotoFilter(r)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid request parameters", err)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request parameters", err)
+		return
+	}
+
+	if r.FormValue("start") == "" {
+		s.getPhotosByCursor(w, r, user, filter)
 		return
 	}
 
-	count, err := strconv.Atoi(r.FormValue("count"))
+	res := GetPhotosResponse{}
+
+	start, count, err := s.parsePage(r)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid request parameters", err)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request parameters", err)
+		return
 	}
 
-	total, err := s.DB.GetNumPhotos(user)
+	total, err := s.DB.GetNumPhotos(r.Context(), user, filter)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get photos from database", err)
+		respondWithDBError(w, r, err, "photo", "failed to get photos from database")
 		return
 	}
 
@@ -220,96 +498,187 @@ func (s *Server) handleGetPhotos(w http.ResponseWriter, r *http.Request, user mo
 		res.HasMore = false
 	}
 
-	photos, err := s.DB.GetPhotos(user, start, count)
+	photos, err := s.DB.GetPhotos(r.Context(), user, filter, start, count)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get photos from database", err)
+		respondWithDBError(w, r, err, "photo", "failed to get photos from database")
+		return
+	}
+
+	if !s.populatePhotoList(w, r, photos, signAllOriginals) {
 		return
 	}
 
-	sess, err := getNewAWSSession(os.Getenv("AWS_REGION"))
+	res.Items = *photos
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// parsePage reads the start and count parameters of a listing by offset. Both default to the first page.
+func (s *Server) parsePage(r *http.Request) (int, int, error) {
+	start := 0
+	if value := r.FormValue("start"); value != "" {
+		var err error
+		if start, err = strconv.Atoi(value); err != nil {
+			return 0, 0, err
+		}
+
+		if start < 0 {
+			return 0, 0, errors.New("start can't be negative")
+		}
+	}
+
+	count, err := s.parseCount(r)
+	return start, count, err
+}
+
+// parseCount reads how many photos a listing should return, which is capped at the configured page size
+func (s *Server) parseCount(r *http.Request) (int, error) {
+	value := r.FormValue("count")
+	if value == "" {
+		return DEFAULT_PAGE_SIZE, nil
+	}
+
+	count, err := strconv.Atoi(value)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "unable to establish AWS session", err)
+		return 0, err
+	}
+
+	if count < 0 {
+		return 0, errors.New("count can't be negative")
+	}
+
+	if count > s.Config.HTTP.MaxPageSize {
+		count = s.Config.HTTP.MaxPageSize
+	}
+
+	return count, nil
+}
+
+func (s *Server) getPhotosByCursor(w http.ResponseWriter, r *http.Request, user models.User, filter db.PhotoFilter) {
+	res := GetPhotosResponse{}
+
+	count, err := s.parseCount(r)
+	if err == nil && count == 0 {
+		err = errors.New("count must be positive")
+	}
+
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request parameters", err)
 		return
 	}
 
-	for i, photo := range photos.Photos {
-		signedUrl, err := generateSignedUrl(sess, os.Getenv("S3_BUCKET"), photo.Key, photo.Filename)
+	var after, before *db.PhotoCursor
+	if token := r.FormValue("cursor"); token != "" {
+		cursor, err := s.decodeCursor(token)
 		if err != nil {
-			msg := fmt.Sprintf("error signing url for photo %s", photo.ID)
-			logErrorAndRespond(w, http.StatusInternalServerError, msg, err)
+			logErrorAndRespond(w, r, http.StatusBadRequest, "invalid cursor", err)
+			return
+		}
+
+		// Continue in the order the cursor was created for, which the request can't change part way through
+		sortGiven := r.FormValue("sort") != "" || r.FormValue("order") != ""
+		if sortGiven && (filter.Sort != cursor.Sort || filter.Ascending != cursor.Ascending) {
+			respondWithError(w, r, http.StatusBadRequest, "cursor was created for a different sort order")
 			return
 		}
 
-		thumbUrl, err := generateSignedUrl(sess, os.Getenv("S3_BUCKET"), photo.Thumbnail, photo.Thumbnail+".jpeg")
+		filter.Sort = cursor.Sort
+		filter.Ascending = cursor.Ascending
+
+		position := &db.PhotoCursor{Value: cursor.Value, ID: cursor.ID}
+		if cursor.Before {
+			before = position
+		} else {
+			after = position
+		}
+	}
+
+	page, err := s.DB.GetPhotosByCursor(r.Context(), user, filter, after, before, count)
+	if err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to get photos from database")
+		return
+	}
+
+	if page.HasNext && len(page.Photos.Photos) > 0 {
+		res.NextCursor, err = s.encodeCursor(filter, page.Last, false)
 		if err != nil {
-			msg := fmt.Sprintf("error signing url for thumbnail %s", photo.ID)
-			logErrorAndRespond(w, http.StatusInternalServerError, msg, err)
+			logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to create cursor", err)
 			return
 		}
+	}
 
-		details, err := s.DB.GetDetailForPhoto(photo.ID)
+	if page.HasPrev && len(page.Photos.Photos) > 0 {
+		res.PrevCursor, err = s.encodeCursor(filter, page.First, true)
 		if err != nil {
-			msg := fmt.Sprintf("error retrieving details for photo %s", photo.ID)
-			logErrorAndRespond(w, http.StatusInternalServerError, msg, err)
+			logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to create cursor", err)
 			return
 		}
+	}
 
-		photos.Photos[i].Url = signedUrl
-		photos.Photos[i].ThumbnailUrl = thumbUrl
-		photos.Photos[i].Details = details
+	if !s.populatePhotoList(w, r, &page.Photos, signAllOriginals) {
+		return
 	}
 
-	res.Items = *photos
+	res.HasMore = page.HasNext
+	res.Items = page.Photos
 	respondWithJSON(w, http.StatusOK, res)
 }
 
+// populatePhotoList signs every photo's thumbnail, and its original only if original allows it. If any photo fails,
+// an error response is written and false is returned.
+func (s *Server) populatePhotoList(w http.ResponseWriter, r *http.Request, photos *models.PhotoList, original signOriginal) bool {
+	photo, err := s.signer.SignPhotos(r.Context(), photos.Photos, original)
+	if err != nil {
+		msg := "error signing photo urls"
+		if photo != nil {
+			msg = fmt.Sprintf("error signing urls for photo %s", photo.ID)
+		}
+
+		logErrorAndRespond(w, r, http.StatusInternalServerError, msg, err)
+		return false
+	}
+
+	return true
+}
+
 func (s *Server) handleGetPhotoByID(w http.ResponseWriter, r *http.Request, user models.User) {
 	params := mux.Vars(r)
 	id := params["id"]
 
-	photo, err := s.DB.GetPhotoById(id)
+	photo, err := s.DB.GetPhotoWithDetail(r.Context(), id)
 	if err != nil {
-		switch err.Error() {
-		case "no matching record":
-			logErrorAndRespond(w, http.StatusNotFound, "photo does not exist", err)
-			return
-		default:
-			logErrorAndRespond(w, http.StatusInternalServerError, "failed to get photo", err)
-			return
-		}
+		respondWithDBError(w, r, err, "photo", "failed to get photo")
+		return
 	}
 
-	if photo.User != user.Email {
-		respondWithError(w, http.StatusForbidden, "you don't have permission to view this photo")
+	permission, ok := s.checkPhotoPermission(w, r, photo, user, models.PermissionView, "view")
+	if !ok {
 		return
 	}
 
-	detail, err := s.DB.GetDetailForPhoto(id)
-	if err != nil {
-		switch err.Error() {
-		case "no matching record":
-			logErrorAndRespond(w, http.StatusNotFound, "photo details do not exist", err)
-			return
-		default:
-			logErrorAndRespond(w, http.StatusInternalServerError, "failed to get photo details", err)
-			return
-		}
+	if photo.Details.ID == "" {
+		respondWithError(w, r, http.StatusNotFound, "photo details do not exist")
+		return
 	}
 
-	sess, err := getNewAWSSession(os.Getenv("AWS_REGION"))
+	thumbUrl, err := s.signer.Sign(r.Context(), photo.Thumbnail, photo.Thumbnail+".jpeg")
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "unable to establish AWS session", err)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "error signing url for thumbnail", err)
 		return
 	}
 
-	signedUrl, err := generateSignedUrl(sess, os.Getenv("S3_BUCKET"), photo.Key, photo.Filename)
-	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "error signing url for photo", err)
-		return
+	// Users the photo was only shared with for viewing don't get the original
+	if permission >= models.PermissionDownload {
+		signedUrl, err := s.signer.Sign(r.Context(), photo.Key, photo.Filename)
+		if err != nil {
+			logErrorAndRespond(w, r, http.StatusInternalServerError, "error signing url for photo", err)
+			return
+		}
+
+		photo.Url = signedUrl
 	}
 
-	photo.Url = signedUrl
-	photo.Details = detail
+	photo.ThumbnailUrl = thumbUrl
+	photo.Permission = permission.String()
 
 	respondWithJSON(w, http.StatusOK, photo)
 }
@@ -318,60 +687,28 @@ func (s *Server) handleDeletePhoto(w http.ResponseWriter, r *http.Request, user
 	params := mux.Vars(r)
 	id := params["id"]
 
-	photo, err := s.DB.GetPhotoById(id)
+	photo, err := s.DB.GetPhotoById(r.Context(), id)
 	if err != nil {
-		switch err.Error() {
-		case "no matching record":
-			logErrorAndRespond(w, http.StatusNotFound, "photo does not exist", err)
-			return
-		default:
-			logErrorAndRespond(w, http.StatusInternalServerError, "failed to get photo", err)
-			return
-		}
-	}
-
-	if photo.User != user.Email {
-		respondWithError(w, http.StatusForbidden, "you don't have permission to view this photo")
+		respondWithDBError(w, r, err, "photo", "failed to get photo")
 		return
 	}
 
-	// Remove photo from S3
-	sess, err := getNewAWSSession(os.Getenv("AWS_REGION"))
-	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to establish AWS session", err)
+	if _, ok := s.checkPhotoPermission(w, r, photo, user, models.PermissionOwner, "delete"); !ok {
 		return
 	}
 
-	svc := s3.New(sess)
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
-		Key:    aws.String(photo.Key),
-	})
-
-	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "unable to delete photo", err)
+	// Deleting the row also queues the objects for deletion, so the photo is gone as soon as this succeeds
+	if err := s.DB.DeletePhoto(r.Context(), photo); err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to delete photo")
 		return
 	}
 
-	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(os.Getenv("S3_BUCKET")),
-		Key:    aws.String(photo.Thumbnail),
-	})
+	// Remove photo from storage. Anything that can't be removed now stays queued and is retried later.
+	ctx, cancel := detach(r.Context())
+	defer cancel()
 
-	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "unable to delete photo", err)
-		return
-	}
-
-	if err := s.DB.DeletePhoto(id); err != nil {
-		switch err.Error() {
-		case "no matching record":
-			logErrorAndRespond(w, http.StatusNotFound, "photo does not exist", err)
-			return
-		default:
-			logErrorAndRespond(w, http.StatusInternalServerError, "failed to delete photo", err)
-			return
-		}
+	if _, err := s.purgeObjects(ctx, []string{photo.Key, photo.Thumbnail}); err != nil {
+		logger(r).WithError(err).Warn("failed to delete photo from storage, it will be retried")
 	}
 
 	respondWithJSON(w, http.StatusOK, nil)
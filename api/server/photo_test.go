@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+// testJPEG encodes a small image that differs for every seed
+func testJPEG(t *testing.T, seed uint8) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x) * 4, G: uint8(y) * 5, B: seed, A: 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		t.Fatalf("failed to encode image: %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+// uploadRequest builds a request that uploads a photo as a multipart form
+func uploadRequest(t *testing.T, token, target, fileName string, photo []byte) *http.Request {
+	t.Helper()
+
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("photo", fileName)
+	if err != nil {
+		t.Fatalf("failed to create form: %s", err)
+	}
+
+	part.Write(photo)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, target, body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// barrierStorage holds back thumbnails until every upload has stored one, so that uploads are all past the
+// duplicate check before any of them adds its photo
+type barrierStorage struct {
+	storage.Storage
+	arrived sync.WaitGroup
+	ready   chan struct{}
+	once    sync.Once
+}
+
+func newBarrierStorage(uploads int) *barrierStorage {
+	b := &barrierStorage{Storage: storage.NewMemory(), ready: make(chan struct{})}
+	b.arrived.Add(uploads)
+
+	go func() {
+		b.arrived.Wait()
+		close(b.ready)
+	}()
+
+	return b
+}
+
+func (b *barrierStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if strings.HasSuffix(key, "_thumb.jpeg") {
+		b.arrived.Done()
+
+		select {
+		case <-b.ready:
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	return b.Storage.Put(ctx, key, body)
+}
+
+func TestConcurrentDuplicateUploads(t *testing.T) {
+	const uploads = 8
+
+	s := newTestServerWithStorage(t, newBarrierStorage(uploads))
+	user, token := addTestUser(t, s, "owner@example.com")
+	photo := testJPEG(t, 1)
+
+	ids := make([]string, uploads)
+	var wg sync.WaitGroup
+
+	for i := 0; i < uploads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			w := serve(s, uploadRequest(t, token, "/photos", "photo.jpeg", photo))
+			if w.Code != http.StatusOK {
+				t.Errorf("upload %d: expected status 200, got %d: %s", i, w.Code, w.Body)
+				return
+			}
+
+			created := models.Photo{}
+			if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+				t.Errorf("upload %d: failed to decode response: %s", i, err)
+				return
+			}
+
+			ids[i] = created.ID
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, id := range ids {
+		if id != ids[0] {
+			t.Errorf("upload %d created photo %s, expected every upload to return %s", i, id, ids[0])
+		}
+	}
+
+	count, err := s.DB.GetNumPhotos(context.Background(), user, db.PhotoFilter{})
+	if err != nil {
+		t.Fatalf("failed to count photos: %s", err)
+	}
+
+	if count != 1 {
+		t.Errorf("expected 1 photo, got %d", count)
+	}
+
+	var keys []string
+	err = s.Storage.List(context.Background(), func(info storage.ObjectInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to list storage: %s", err)
+	}
+
+	if len(keys) != 2 {
+		t.Errorf("expected the original and thumbnail in storage, got %v", keys)
+	}
+}
+
+func TestDuplicateUploadRejected(t *testing.T) {
+	s := newTestServer(t)
+	_, token := addTestUser(t, s, "owner@example.com")
+	photo := testJPEG(t, 2)
+
+	w := serve(s, uploadRequest(t, token, "/photos", "photo.jpeg", photo))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(s, uploadRequest(t, token, "/photos?on_duplicate=reject", "again.jpeg", photo))
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected status 409, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestUploadSizeLimit(t *testing.T) {
+	s := newTestServer(t)
+	_, token := addTestUser(t, s, "owner@example.com")
+	photo := testJPEG(t, 6)
+
+	// The limit applies to the photo, not the form it is sent in
+	s.Config.Upload.MaxSize = int64(len(photo))
+	if w := serve(s, uploadRequest(t, token, "/photos", "photo.jpeg", photo)); w.Code != http.StatusOK {
+		t.Fatalf("expected a photo at the limit to be accepted, got %d: %s", w.Code, w.Body)
+	}
+
+	s.Config.Upload.MaxSize = int64(len(photo)) - 1
+	limit := fmt.Sprintf("the limit is %d bytes", s.Config.Upload.MaxSize)
+
+	w := serve(s, uploadRequest(t, token, "/photos", "photo.jpeg", testJPEG(t, 7)))
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), limit) {
+		t.Errorf("expected status 413 giving the limit for a photo over it, got %d: %s", w.Code, w.Body)
+	}
+
+	// A form that is too large as a whole is reported the same way
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	form.WriteField("note", strings.Repeat("a", int(s.Config.Upload.MaxSize)+FORM_ENVELOPE_SIZE))
+	part, _ := form.CreateFormFile("photo", "photo.jpeg")
+	part.Write(photo)
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/photos", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w = serve(s, r)
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), limit) {
+		t.Errorf("expected status 413 giving the limit for a form over it, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAddPhotoRejectsDuplicateHash(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := addTestUser(t, s, "owner@example.com")
+	sha256 := strings.Repeat("cd", 32)
+	withHash := func(photo *models.Photo) { photo.Details.SHA256 = sha256 }
+
+	addTestPhoto(t, s, user, "2Dq4xNqvqgkIjS8ekmNuR1fcgSs", withHash)
+
+	duplicate := testPhoto(user, "2Dq4xPPf6ThbPEOLGa5UXE8Sf0A")
+	withHash(&duplicate)
+
+	if err := s.DB.AddPhoto(context.Background(), &duplicate); !errors.Is(err, db.ErrDuplicatePhoto) {
+		t.Errorf("expected ErrDuplicatePhoto, got %v", err)
+	}
+}
+
+func TestGetPhotosPaging(t *testing.T) {
+	s := newTestServer(t)
+	s.Config.HTTP.MaxPageSize = 2
+	user, token := addTestUser(t, s, "owner@example.com")
+
+	for _, id := range []string{"2DqDp0tWqTnXKyTA8IwkJzDxW01", "2DqDp0tWqTnXKyTA8IwkJzDxW02", "2DqDp0tWqTnXKyTA8IwkJzDxW03"} {
+		addTestPhoto(t, s, user, id)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/photos?"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return serve(s, r)
+	}
+
+	for _, query := range []string{"start=-1&count=10", "start=0&count=-1", "count=-1", "count=0"} {
+		if w := get(query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", query, w.Code, w.Body)
+		}
+	}
+
+	for _, query := range []string{"start=0&count=100", "count=100"} {
+		w := get(query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", query, w.Code, w.Body)
+		}
+
+		res := GetPhotosResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: failed to decode response: %s", query, err)
+		}
+
+		if len(res.Items.Photos) != 2 || !res.HasMore {
+			t.Errorf("%s: expected a page of 2 photos with more to come, got %d photos", query, len(res.Items.Photos))
+		}
+	}
+}
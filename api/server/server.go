@@ -1,76 +1,195 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/yanchenm/photo-sync/config"
 	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/storage"
 )
 
+// READ_HEADER_TIMEOUT stops clients from holding connections open without ever sending a request
+const READ_HEADER_TIMEOUT = 10 * time.Second
+
 type Server struct {
-	Router *mux.Router
-	DB     *db.Database
+	Router  *mux.Router
+	DB      db.Repository
+	Storage storage.Storage
+	Config  config.Config
+
+	signer  *urlSigner
+	metrics *metrics
 }
 
-func Initialize(username, password, database string) (*Server, error) {
-	newDB, err := db.Initialize(username, password, database)
+// Initialize connects to the database and storage described by cfg, which must already be valid
+func Initialize(cfg config.Config) (*Server, error) {
+	newDB, err := OpenDatabase(cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AutoMigrate {
+		if _, err := newDB.MigrateUp(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+
+	store, err := NewStorage(cfg.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	router := mux.NewRouter()
+	return New(cfg, newDB, store), nil
+}
+
+// New creates a server backed by the given database and storage
+func New(cfg config.Config, repo db.Repository, store storage.Storage) *Server {
+	m := newMetrics(repo.Stats)
+	store = instrumentedStorage{Storage: store, metrics: m}
 
 	s := &Server{
-		DB:     &newDB,
-		Router: router,
+		DB:      repo,
+		Router:  mux.NewRouter(),
+		Storage: store,
+		Config:  cfg,
+		signer:  newUrlSigner(store, SIGNED_URL_EXPIRY),
+		metrics: m,
 	}
 
 	s.initializeRoutes()
-	return s, nil
+	return s
 }
 
 func (s *Server) initializeRoutes() {
+	s.Router.Use(s.traceRequests, s.logRequests, s.instrument)
+
+	s.Router.Handle("/metrics", s.handleMetrics()).Methods("GET")
+	s.Router.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	s.Router.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	s.Router.HandleFunc("/version", s.handleVersion).Methods("GET")
+	s.Router.HandleFunc("/admin/consistency", s.handleCheckConsistency).Methods("GET", "POST")
 	s.Router.HandleFunc("/users/new", s.handleAddUser).Methods("POST")
 	s.Router.HandleFunc("/photos", s.authenticate(s.handleUploadPhoto)).Methods("POST")
 	s.Router.HandleFunc("/photos", s.authenticate(s.handleGetPhotos)).Methods("GET")
+	s.Router.HandleFunc("/photos/batch", s.authenticate(s.handleUploadPhotoBatch)).Methods("POST")
 	s.Router.HandleFunc("/photos/{id}", s.authenticate(s.handleGetPhotoByID)).Methods("GET")
 	s.Router.HandleFunc("/photos/{id}", s.authenticate(s.handleDeletePhoto)).Methods("DELETE")
+	s.Router.HandleFunc("/photos/{id}/shares", s.authenticate(s.handleSharePhoto)).Methods("POST")
+	s.Router.HandleFunc("/photos/{id}/shares", s.authenticate(s.handleGetPhotoShares)).Methods("GET")
+	s.Router.HandleFunc("/photos/{id}/shares/{email}", s.authenticate(s.handleUnsharePhoto)).Methods("DELETE")
+
+	// Resumable uploads speak the tus protocol, which has its own version header
+	uploads := s.Router.PathPrefix("/uploads").Subrouter()
+	uploads.Use(s.tusResumable)
+	uploads.HandleFunc("", s.handleUploadOptions).Methods("OPTIONS")
+	uploads.HandleFunc("", s.authenticate(s.handleCreateUpload)).Methods("POST")
+	uploads.HandleFunc("/{id}", s.handleUploadOptions).Methods("OPTIONS")
+	uploads.HandleFunc("/{id}", s.authenticate(s.handleGetUploadOffset)).Methods("HEAD").Name("upload")
+	uploads.HandleFunc("/{id}", s.authenticate(s.handlePatchUpload)).Methods("PATCH")
+	uploads.HandleFunc("/{id}", s.authenticate(s.handleDeleteUpload)).Methods("DELETE")
+
+	s.Router.HandleFunc("/upload-slots", s.authenticate(s.handleCreateUploadSlot)).Methods("POST")
+	s.Router.HandleFunc("/upload-slots/{id}/finalize", s.authenticate(s.handleFinalizeUploadSlot)).Methods("POST")
+	s.Router.HandleFunc("/shared", s.authenticate(s.handleGetSharedPhotos)).Methods("GET")
+	s.Router.HandleFunc("/links", s.authenticate(s.handleCreateShareLink)).Methods("POST")
+	s.Router.HandleFunc("/links", s.authenticate(s.handleGetShareLinks)).Methods("GET")
+	s.Router.HandleFunc("/links/{token}", s.authenticate(s.handleRevokeShareLink)).Methods("DELETE")
+	s.Router.HandleFunc("/public/{token}", s.handleGetPublicLink).Methods("GET")
+	s.Router.HandleFunc("/albums", s.authenticate(s.handleCreateAlbum)).Methods("POST")
+	s.Router.HandleFunc("/albums", s.authenticate(s.handleGetAlbums)).Methods("GET")
+	s.Router.HandleFunc("/albums/{id}", s.authenticate(s.handleGetAlbumByID)).Methods("GET")
+	s.Router.HandleFunc("/albums/{id}", s.authenticate(s.handleRenameAlbum)).Methods("PUT")
+	s.Router.HandleFunc("/albums/{id}", s.authenticate(s.handleDeleteAlbum)).Methods("DELETE")
+	s.Router.HandleFunc("/albums/{id}/photos", s.authenticate(s.handleAddAlbumPhotos)).Methods("POST")
+	s.Router.HandleFunc("/albums/{id}/photos/{photoId}", s.authenticate(s.handleRemoveAlbumPhoto)).Methods("DELETE")
+	s.Router.HandleFunc("/albums/{id}/order", s.authenticate(s.handleReorderAlbum)).Methods("PUT")
+	s.Router.HandleFunc("/albums/{id}/cover", s.authenticate(s.handleSetAlbumCover)).Methods("PUT")
 	s.Router.HandleFunc("/login", s.login).Methods("POST")
 	s.Router.HandleFunc("/logout", s.authenticate(s.logout)).Methods("POST")
 	s.Router.HandleFunc("/refresh", s.refreshAuth).Methods("POST")
 	s.Router.HandleFunc("/user", s.authenticate(s.handleGetAuthenticatedUser)).Methods("GET")
 	s.Router.HandleFunc("/user/{email}", s.authenticate(s.handleGetUserByEmail)).Methods("GET")
-}
 
-func (s *Server) Run(addr string) {
-	var frontendUrl string
-	if os.Getenv("ENVIRONMENT") == "PROD" {
-		frontendUrl = "https://photos.runny.cloud"
-	} else {
-		frontendUrl = "http://localhost:3000"
+	// Backends that sign their own URLs also need to serve them, and accept the uploads they signed
+	backend := s.Storage
+	if wrapped, ok := backend.(interface{ Unwrap() storage.Storage }); ok {
+		backend = wrapped.Unwrap()
 	}
 
+	if handler, ok := backend.(http.Handler); ok {
+		s.Router.PathPrefix(storage.LocalURLPrefix).Handler(handler).Methods("GET", "HEAD", "PUT")
+	}
+}
+
+// Handler wraps the router with the CORS handling needed when the API is served directly rather than behind
+// API Gateway
+func (s *Server) Handler() http.Handler {
 	c := cors.New(cors.Options{
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodDelete},
-		AllowedOrigins:   []string{frontendUrl},
+		AllowedMethods: []string{
+			http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		},
+		AllowedOrigins:   s.Config.CORSOrigins,
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   append(tusHeaders, IDEMPOTENCY_REPLAYED_HEADER),
 		AllowCredentials: true,
-		Debug:            true,
+		Debug:            !s.Config.Production(),
 	})
 
-	loggedRouter := handlers.LoggingHandler(os.Stdout, s.Router)
-	handler := c.Handler(loggedRouter)
-	log.Fatal(http.ListenAndServe(addr, handler))
-	defer s.DB.Conn.Close()
+	return c.Handler(s.Router)
+}
+
+// Run serves the API until ctx is cancelled, then stops accepting connections and waits up to the shutdown
+// timeout for in-flight requests, such as uploads, to finish
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.Config.HTTP.Addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+		ReadTimeout:       s.Config.HTTP.ReadTimeout,
+		WriteTimeout:      s.Config.HTTP.WriteTimeout,
+		IdleTimeout:       s.Config.HTTP.IdleTimeout,
+	}
+
+	// Storage cleanup that failed during a request is retried until the server stops
+	purgeCtx, stopPurge := context.WithCancel(ctx)
+	defer stopPurge()
+	go s.purgeLoop(purgeCtx)
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Infof("listening on %s", srv.Addr)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Info("shutting down, waiting for in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.Config.HTTP.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down cleanly: %w", err)
+	}
+
+	return nil
+}
+
+// Close releases the database connections held by the server
+func (s *Server) Close() error {
+	return s.DB.Close()
 }
 
 func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
@@ -81,17 +200,32 @@ func respondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	_, _ = w.Write(response)
 }
 
-func respondWithError(w http.ResponseWriter, status int, message string) {
-	respondWithJSON(w, status, map[string]string{"error": message})
+// respondWithError includes the request id so that users can quote it when reporting a problem
+func respondWithError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	respondWithJSON(w, status, map[string]string{"error": message, "request_id": requestID(r)})
 }
 
-func logErrorAndRespond(w http.ResponseWriter, status int, message string, err error) {
-	log.Error(fmt.Sprintf("%s: %s", message, err))
-	respondWithError(w, status, message)
+func logErrorAndRespond(w http.ResponseWriter, r *http.Request, status int, message string, err error) {
+	entry := logger(r).WithField("status", status)
+	if err != nil {
+		entry = entry.WithError(err)
+		trace.SpanFromContext(r.Context()).RecordError(err)
+	}
+
+	entry.Error(message)
+	respondWithError(w, r, status, message)
 }
 
-func getNewAWSSession(region string) (*session.Session, error) {
-	return session.NewSession(&aws.Config{
-		Region: aws.String(region),
-	})
+// NewStorage creates the storage backend described by the configuration
+func NewStorage(cfg config.Storage) (storage.Storage, error) {
+	switch cfg.Backend {
+	case "", "s3":
+		return storage.NewS3(cfg.Region, cfg.Bucket)
+	case "local":
+		return storage.NewLocal(cfg.Path, cfg.URL, []byte(cfg.SigningKey))
+	case "memory":
+		return storage.NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
 }
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yanchenm/photo-sync/config"
+	"github.com/yanchenm/photo-sync/models"
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+// newTestServer creates a server backed by a fresh SQLite database and in-memory storage
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	return newTestServerWithStorage(t, storage.NewMemory())
+}
+
+// newTestServerWithStorage creates a server backed by a fresh SQLite database and the given storage
+func newTestServerWithStorage(t *testing.T, store storage.Storage) *Server {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Database.Driver = "sqlite"
+	cfg.Database.SQLitePath = filepath.Join(t.TempDir(), "photo-sync.db")
+	cfg.Storage.Backend = "memory"
+	cfg.Auth.AccessTokenKey = "access"
+	cfg.Auth.RefreshTokenKey = "refresh"
+
+	database, err := OpenDatabase(cfg.Database)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+
+	t.Cleanup(func() { database.Close() })
+
+	if _, err := database.MigrateUp(context.Background()); err != nil {
+		t.Fatalf("failed to migrate database: %s", err)
+	}
+
+	return New(cfg, database, store)
+}
+
+// addTestUser creates a user and returns an access token for them
+func addTestUser(t *testing.T, s *Server, email string) (models.User, string) {
+	t.Helper()
+
+	user := models.User{Email: email, Name: email, Password: "password"}
+	if err := user.HashPassword(); err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+
+	if err := s.DB.AddUser(context.Background(), &user); err != nil {
+		t.Fatalf("failed to add user: %s", err)
+	}
+
+	token, err := generateToken(user.Email, s.Config.Auth.AccessTokenKey, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create access token: %s", err)
+	}
+
+	return user, token
+}
+
+// testPhoto describes a photo owned by user, stored under the keys an upload would give it
+func testPhoto(user models.User, id string) models.Photo {
+	return models.Photo{
+		ID:        id,
+		User:      user.Email,
+		Filename:  "photo.jpeg",
+		Key:       id + ".jpeg",
+		Thumbnail: id + "_thumb.jpeg",
+		Details:   models.Detail{ID: id, FileType: "jpeg"},
+	}
+}
+
+// addTestPhoto adds a photo owned by user to the database, after applying any edits to it
+func addTestPhoto(t *testing.T, s *Server, user models.User, id string, edits ...func(*models.Photo)) models.Photo {
+	t.Helper()
+
+	photo := testPhoto(user, id)
+	for _, edit := range edits {
+		edit(&photo)
+	}
+
+	if err := s.DB.AddPhoto(context.Background(), &photo); err != nil {
+		t.Fatalf("failed to add photo: %s", err)
+	}
+
+	return photo
+}
+
+// serve sends a request to the server and returns the recorded response
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, r)
+	return w
+}
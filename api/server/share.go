@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+)
+
+type ShareRequest struct {
+	Email      string `json:"email"`
+	Permission string `json:"permission"`
+}
+
+// photoPermission returns the level of access user has to photo, either as its owner or through a share
+func (s *Server) photoPermission(ctx context.Context, photo models.Photo, user models.User) (models.Permission, error) {
+	if photo.User == user.Email {
+		return models.PermissionOwner, nil
+	}
+
+	name, err := s.DB.GetSharePermission(ctx, photo.ID, user.Email)
+	if errors.Is(err, db.ErrNotFound) {
+		return models.PermissionNone, nil
+	} else if err != nil {
+		return models.PermissionNone, err
+	}
+
+	permission, _ := models.ParseSharePermission(name)
+	return permission, nil
+}
+
+// checkPhotoPermission verifies that user has at least the required access to photo. If not, an error response is
+// written and false is returned.
+func (s *Server) checkPhotoPermission(w http.ResponseWriter, r *http.Request, photo models.Photo, user models.User, required models.Permission, action string) (models.Permission, bool) {
+	permission, err := s.photoPermission(r.Context(), photo, user)
+	if err != nil {
+		respondWithDBError(w, r, err, "share", "failed to check photo permissions")
+		return permission, false
+	}
+
+	if permission < required {
+		respondWithError(w, r, http.StatusForbidden, fmt.Sprintf("you don't have permission to %s this photo", action))
+		return permission, false
+	}
+
+	return permission, true
+}
+
+// getOwnedPhoto loads the photo in the request path and checks that it belongs to the user. If it doesn't, an
+// error response is written and false is returned.
+func (s *Server) getOwnedPhoto(w http.ResponseWriter, r *http.Request, user models.User) (models.Photo, bool) {
+	params := mux.Vars(r)
+	id := params["id"]
+
+	photo, err := s.DB.GetPhotoById(r.Context(), id)
+	if err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to get photo")
+		return photo, false
+	}
+
+	_, ok := s.checkPhotoPermission(w, r, photo, user, models.PermissionOwner, "share")
+	return photo, ok
+}
+
+func (s *Server) handleSharePhoto(w http.ResponseWriter, r *http.Request, user models.User) {
+	photo, ok := s.getOwnedPhoto(w, r, user)
+	if !ok {
+		return
+	}
+
+	req := ShareRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request payload", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if req.Email == "" {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("[email]"))
+		return
+	}
+
+	if req.Email == user.Email {
+		respondWithError(w, r, http.StatusBadRequest, "you can't share a photo with yourself")
+		return
+	}
+
+	if req.Permission == "" {
+		req.Permission = models.PermissionView.String()
+	}
+
+	if _, ok := models.ParseSharePermission(req.Permission); !ok {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "permission must be view or download", fmt.Errorf("%s", req.Permission))
+		return
+	}
+
+	if _, err := s.DB.GetUserFromEmail(r.Context(), req.Email); err != nil {
+		respondWithDBError(w, r, err, "user", "failed to get user details")
+		return
+	}
+
+	share := models.Share{
+		PhotoID:    photo.ID,
+		Email:      req.Email,
+		Permission: req.Permission,
+	}
+
+	if err := s.DB.AddShare(r.Context(), &share); err != nil {
+		respondWithDBError(w, r, err, "share", "failed to share photo")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, share)
+}
+
+func (s *Server) handleGetPhotoShares(w http.ResponseWriter, r *http.Request, user models.User) {
+	photo, ok := s.getOwnedPhoto(w, r, user)
+	if !ok {
+		return
+	}
+
+	shares, err := s.DB.GetSharesForPhoto(r.Context(), photo.ID)
+	if err != nil {
+		respondWithDBError(w, r, err, "share", "failed to get shares from database")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, shares)
+}
+
+func (s *Server) handleUnsharePhoto(w http.ResponseWriter, r *http.Request, user models.User) {
+	photo, ok := s.getOwnedPhoto(w, r, user)
+	if !ok {
+		return
+	}
+
+	params := mux.Vars(r)
+	email := params["email"]
+
+	if err := s.DB.DeleteShare(r.Context(), photo.ID, email); err != nil {
+		respondWithDBError(w, r, err, "share", "failed to unshare photo")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+func (s *Server) handleGetSharedPhotos(w http.ResponseWriter, r *http.Request, user models.User) {
+	res := GetPhotosResponse{}
+
+	start, count, err := s.parsePage(r)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request parameters", err)
+		return
+	}
+
+	// Fetch one extra photo to find out whether there are more
+	photos, err := s.DB.GetSharedPhotos(r.Context(), user, start, count+1)
+	if err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to get shared photos from database")
+		return
+	}
+
+	if len(photos.Photos) > count {
+		photos.Photos = photos.Photos[:count]
+		res.HasMore = true
+	}
+
+	// Only photos shared for download include the original
+	downloadable := func(photo models.Photo) bool {
+		return photo.Permission != models.PermissionView.String()
+	}
+
+	if !s.populatePhotoList(w, r, photos, downloadable) {
+		return
+	}
+
+	res.Items = *photos
+	respondWithJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yanchenm/photo-sync/models"
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+// signingStorage records every key that a url is signed for
+type signingStorage struct {
+	storage.Storage
+	mu     sync.Mutex
+	signed map[string]bool
+}
+
+func (s *signingStorage) SignedURL(ctx context.Context, key, fileName string, expiry time.Duration) (string, error) {
+	s.mu.Lock()
+	s.signed[key] = true
+	s.mu.Unlock()
+
+	return s.Storage.SignedURL(ctx, key, fileName, expiry)
+}
+
+func TestSharedPhotosSignOnlyDownloadableOriginals(t *testing.T) {
+	store := &signingStorage{Storage: storage.NewMemory(), signed: make(map[string]bool)}
+	s := newTestServerWithStorage(t, store)
+	ctx := context.Background()
+	owner, _ := addTestUser(t, s, "owner@example.com")
+	viewer, token := addTestUser(t, s, "viewer@example.com")
+
+	permissions := map[string]models.Permission{
+		"2DqEjm0Kp0tTnmwUkUBWpvwwf01": models.PermissionView,
+		"2DqEjm0Kp0tTnmwUkUBWpvwwf02": models.PermissionDownload,
+	}
+
+	for id, permission := range permissions {
+		addTestPhoto(t, s, owner, id)
+
+		share := models.Share{PhotoID: id, Email: viewer.Email, Permission: permission.String()}
+		if err := s.DB.AddShare(ctx, &share); err != nil {
+			t.Fatalf("failed to share photo: %s", err)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/shared", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	res := GetPhotosResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	if len(res.Items.Photos) != len(permissions) {
+		t.Fatalf("expected %d photos, got %d", len(permissions), len(res.Items.Photos))
+	}
+
+	for _, photo := range res.Items.Photos {
+		downloadable := permissions[photo.ID] == models.PermissionDownload
+
+		if photo.ThumbnailUrl == "" {
+			t.Errorf("photo %s: expected a thumbnail url", photo.ID)
+		}
+
+		if (photo.Url != "") != downloadable {
+			t.Errorf("photo %s: expected an original url only if it can be downloaded, got %q", photo.ID, photo.Url)
+		}
+
+		if store.signed[photo.ID+".jpeg"] != downloadable {
+			t.Errorf("photo %s: expected the original to be signed only if it can be downloaded", photo.ID)
+		}
+	}
+}
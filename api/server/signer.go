@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/yanchenm/photo-sync/models"
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+const (
+	SIGNING_CONCURRENCY = 8
+	SIGNED_URL_CACHE    = 10000
+)
+
+type cachedUrl struct {
+	url     string
+	expires time.Time
+}
+
+// urlSigner signs download urls for photos, reusing previously signed urls while they still have at least
+// minValidity left so that clients get stable urls they can cache.
+type urlSigner struct {
+	storage     storage.Storage
+	expiry      time.Duration
+	minValidity time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedUrl
+}
+
+func newUrlSigner(store storage.Storage, expiry time.Duration) *urlSigner {
+	return &urlSigner{
+		storage:     store,
+		expiry:      expiry,
+		minValidity: expiry / 3,
+		cache:       make(map[string]cachedUrl),
+	}
+}
+
+func (u *urlSigner) Sign(ctx context.Context, key, fileName string) (string, error) {
+	now := time.Now()
+
+	u.mu.Lock()
+	cached, ok := u.cache[key]
+	u.mu.Unlock()
+
+	if ok && cached.expires.Sub(now) >= u.minValidity {
+		return cached.url, nil
+	}
+
+	url, err := u.storage.SignedURL(ctx, key, fileName, u.expiry)
+	if err != nil {
+		return "", err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if len(u.cache) >= SIGNED_URL_CACHE {
+		u.evict(now)
+	}
+
+	u.cache[key] = cachedUrl{url: url, expires: now.Add(u.expiry)}
+	return url, nil
+}
+
+// evict removes urls that are too close to expiry to be reused. If that doesn't free up space, the cache is reset.
+// Must be called with mu held.
+func (u *urlSigner) evict(now time.Time) {
+	for key, cached := range u.cache {
+		if cached.expires.Sub(now) < u.minValidity {
+			delete(u.cache, key)
+		}
+	}
+
+	if len(u.cache) >= SIGNED_URL_CACHE {
+		u.cache = make(map[string]cachedUrl)
+	}
+}
+
+// signOriginal says whether the url of a photo's original is signed along with its thumbnail, so that photos the
+// caller can't download never get one
+type signOriginal func(photo models.Photo) bool
+
+// signAllOriginals signs the original of every photo, for photos the caller can download
+func signAllOriginals(models.Photo) bool {
+	return true
+}
+
+// SignPhotos fills in the thumbnail url of every photo, and the original url of those that original allows, using a
+// bounded pool of workers. Signing stops at the first error, which is returned along with the photo that caused it.
+func (u *urlSigner) SignPhotos(ctx context.Context, photos []models.Photo, original signOriginal) (*models.Photo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failedPhoto *models.Photo
+	var failedErr error
+	var once sync.Once
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+
+	workers := SIGNING_CONCURRENCY
+	if len(photos) < workers {
+		workers = len(photos)
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				err := u.signPhoto(ctx, &photos[i], original(photos[i]))
+				if err != nil {
+					once.Do(func() {
+						failedPhoto, failedErr = &photos[i], err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	for i := range photos {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if failedErr == nil && ctx.Err() != nil {
+		// The caller's context was cancelled before every photo was signed
+		return nil, ctx.Err()
+	}
+
+	return failedPhoto, failedErr
+}
+
+func (u *urlSigner) signPhoto(ctx context.Context, photo *models.Photo, original bool) error {
+	if original {
+		signedUrl, err := u.Sign(ctx, photo.Key, photo.Filename)
+		if err != nil {
+			return err
+		}
+
+		photo.Url = signedUrl
+	}
+
+	thumbUrl, err := u.Sign(ctx, photo.Thumbnail, photo.Thumbnail+".jpeg")
+	if err != nil {
+		return err
+	}
+
+	photo.ThumbnailUrl = thumbUrl
+	return nil
+}
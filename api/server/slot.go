@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+	"github.com/yanchenm/photo-sync/storage"
+)
+
+// UPLOAD_SLOT_EXPIRY is how long a client has to upload a photo through a slot and finalize it. The presigned
+// upload request expires at the same time.
+const UPLOAD_SLOT_EXPIRY = time.Hour
+
+type UploadSlotRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+type UploadSlotResponse struct {
+	models.UploadSlot
+	Upload storage.PresignedUpload `json:"upload"`
+}
+
+// handleCreateUploadSlot reserves a place in storage for a photo and returns a presigned request that uploads it
+// there directly, so that the photo doesn't pass through the API
+func (s *Server) handleCreateUploadSlot(w http.ResponseWriter, r *http.Request, user models.User) {
+	req := UploadSlotRequest{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request payload", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if req.Filename == "" || req.ContentType == "" || req.Size == 0 {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("[filename content_type size]"))
+		return
+	}
+
+	if _, ok := photoTypes[req.ContentType]; !ok {
+		respondWithError(w, r, http.StatusUnsupportedMediaType, "photos must be jpeg, png or gif images")
+		return
+	}
+
+	if req.Size < 0 {
+		respondWithError(w, r, http.StatusBadRequest, "size must be positive")
+		return
+	}
+
+	if req.Size > s.Config.Upload.MaxSize {
+		respondWithHTTPError(w, r, s.tooLargeError(nil))
+		return
+	}
+
+	id := ksuid.New().String()
+	slot := models.UploadSlot{
+		ID:          id,
+		User:        user.Email,
+		Filename:    req.Filename,
+		Key:         id + "_upload",
+		ContentType: req.ContentType,
+		Size:        req.Size,
+		ExpiresAt:   time.Now().Add(UPLOAD_SLOT_EXPIRY),
+	}
+
+	addLogFields(r, log.Fields{"slot_id": id})
+	addSpanAttributes(r, attribute.String("slot_id", id))
+
+	upload, err := s.Storage.SignedUploadURL(r.Context(), slot.Key, slot.ContentType, slot.Size, UPLOAD_SLOT_EXPIRY)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to sign upload url", err)
+		return
+	}
+
+	if err := s.DB.AddUploadSlot(r.Context(), &slot); err != nil {
+		respondWithDBError(w, r, err, "upload slot", "failed to create upload slot")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, UploadSlotResponse{UploadSlot: slot, Upload: upload})
+}
+
+// handleFinalizeUploadSlot creates the photo uploaded through a slot. Finalizing a slot again returns the photo
+// that was created the first time.
+func (s *Server) handleFinalizeUploadSlot(w http.ResponseWriter, r *http.Request, user models.User) {
+	slot, err := s.DB.GetUploadSlot(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		respondWithDBError(w, r, err, "upload slot", "failed to get upload slot")
+		return
+	}
+
+	if slot.User != user.Email {
+		respondWithError(w, r, http.StatusNotFound, "upload slot does not exist")
+		return
+	}
+
+	if slot.PhotoID != "" {
+		s.respondWithSlotPhoto(w, r, slot)
+		return
+	}
+
+	if slot.Expired() {
+		respondWithError(w, r, http.StatusGone, "upload slot has expired")
+		return
+	}
+
+	if !s.checkUploadSlot(w, r, slot) {
+		return
+	}
+
+	// The photo keeps the uploaded object as its original rather than storing another copy
+	photo, duplicate, saveErr := s.saveStoredPhoto(r, user, slot.Filename, slot.Key)
+	if saveErr != nil {
+		respondWithHTTPError(w, r, saveErr)
+		return
+	}
+
+	// The photo is kept if the slot can't be finalized, so that finalizing again finds it as a duplicate
+	if err := s.DB.CompleteUploadSlot(r.Context(), slot.ID, photo.ID); err != nil {
+		if errors.Is(err, db.ErrConflict) {
+			s.finalizedElsewhere(w, r, slot.ID, photo, duplicate)
+			return
+		}
+
+		respondWithDBError(w, r, err, "upload slot", "failed to finalize upload slot")
+		return
+	}
+
+	// A photo that was already uploaded has its own original, so the uploaded object isn't needed
+	if photo.Key != slot.Key {
+		ctx, cancel := detach(r.Context())
+		defer cancel()
+
+		if _, err := s.purgeObjects(ctx, []string{slot.Key}); err != nil {
+			logger(r).WithError(err).Warn("failed to delete uploaded object from storage, it will be retried")
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, photo)
+}
+
+// finalizedElsewhere responds to a finalize request that lost the race with another request finalizing the same
+// slot, by returning the photo that the other request created. This request's photo isn't needed, unless it is
+// the other request's photo too or it was already uploaded before the slot.
+func (s *Server) finalizedElsewhere(w http.ResponseWriter, r *http.Request, id string, photo models.Photo, duplicate bool) {
+	slot, err := s.DB.GetUploadSlot(r.Context(), id)
+	if err != nil {
+		respondWithDBError(w, r, err, "upload slot", "failed to get upload slot")
+		return
+	}
+
+	if !duplicate && slot.PhotoID != photo.ID {
+		s.discardSlotPhoto(r, photo)
+	}
+
+	s.respondWithSlotPhoto(w, r, slot)
+}
+
+// discardSlotPhoto deletes a photo created from a slot that isn't needed. Its original is the slot's object, which
+// another photo may keep, so only the thumbnail is removed from storage straight away. The database queues the
+// original for deletion if no photo uses it.
+func (s *Server) discardSlotPhoto(r *http.Request, photo models.Photo) {
+	ctx, cancel := detach(r.Context())
+	defer cancel()
+
+	if err := s.DB.DeletePhoto(ctx, photo); err != nil {
+		logger(r).WithError(err).Error("failed to delete discarded photo")
+	} else if _, err := s.purgeObjects(ctx, []string{photo.Thumbnail}); err != nil {
+		logger(r).WithError(err).Warn("failed to delete discarded photo from storage, it will be retried")
+	}
+}
+
+// respondWithSlotPhoto responds with the photo that a slot was finalized as
+func (s *Server) respondWithSlotPhoto(w http.ResponseWriter, r *http.Request, slot models.UploadSlot) {
+	photo, err := s.DB.GetPhotoWithDetail(r.Context(), slot.PhotoID)
+	if err != nil {
+		respondWithDBError(w, r, err, "photo", "failed to get photo")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, photo)
+}
+
+// checkUploadSlot checks that the photo has been uploaded through a slot and is the size that was signed for. If
+// not, an error response is written and false is returned.
+func (s *Server) checkUploadSlot(w http.ResponseWriter, r *http.Request, slot models.UploadSlot) bool {
+	info, err := s.Storage.Stat(r.Context(), slot.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, r, http.StatusConflict, "photo has not been uploaded yet")
+		return false
+	} else if err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to check uploaded photo", err)
+		return false
+	}
+
+	if info.Size != slot.Size {
+		err := fmt.Errorf("uploaded %d bytes, expected %d", info.Size, slot.Size)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "uploaded photo is not the expected size", err)
+		return false
+	}
+
+	return true
+}
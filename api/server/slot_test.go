@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+func TestConcurrentFinalizeUploadSlot(t *testing.T) {
+	const requests = 4
+
+	s := newTestServerWithStorage(t, newBarrierStorage(requests))
+	user, token := addTestUser(t, s, "owner@example.com")
+	ctx := context.Background()
+	photo := testJPEG(t, 3)
+
+	slot := models.UploadSlot{
+		ID:          "2DqAH2dkZBZ8vDrXfnCFH1qwGd8",
+		User:        user.Email,
+		Filename:    "photo.jpeg",
+		Key:         "2DqAH2dkZBZ8vDrXfnCFH1qwGd8_upload",
+		ContentType: "image/jpeg",
+		Size:        int64(len(photo)),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+
+	if err := s.DB.AddUploadSlot(ctx, &slot); err != nil {
+		t.Fatalf("failed to add upload slot: %s", err)
+	}
+
+	if err := s.Storage.Put(ctx, slot.Key, bytes.NewReader(photo)); err != nil {
+		t.Fatalf("failed to upload photo: %s", err)
+	}
+
+	ids := make([]string, requests)
+	var wg sync.WaitGroup
+
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r := httptest.NewRequest(http.MethodPost, "/upload-slots/"+slot.ID+"/finalize", nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+
+			w := serve(s, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("finalize %d: expected status 200, got %d: %s", i, w.Code, w.Body)
+				return
+			}
+
+			finalized := models.Photo{}
+			if err := json.Unmarshal(w.Body.Bytes(), &finalized); err != nil {
+				t.Errorf("finalize %d: failed to decode response: %s", i, err)
+				return
+			}
+
+			ids[i] = finalized.ID
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, id := range ids {
+		if id != ids[0] {
+			t.Errorf("finalize %d returned photo %s, expected every request to return %s", i, id, ids[0])
+		}
+	}
+
+	if _, err := s.DB.GetPhotoWithDetail(ctx, ids[0]); err != nil {
+		t.Errorf("expected the finalized photo to exist, got %v", err)
+	}
+
+	// The requests that lost the race must leave the uploaded object to the photo that won
+	if _, err := s.PurgeDeletedObjects(ctx); err != nil {
+		t.Fatalf("failed to purge deleted objects: %s", err)
+	}
+
+	if _, err := s.Storage.Stat(ctx, slot.Key); err != nil {
+		t.Errorf("expected the uploaded object to still be in storage, got %s", err)
+	}
+}
+
+func TestFinalizeUploadSlotKeepsUploadedObject(t *testing.T) {
+	s := newTestServer(t)
+	user, token := addTestUser(t, s, "owner@example.com")
+	ctx := context.Background()
+	photo := testJPEG(t, 5)
+
+	slot := models.UploadSlot{
+		ID:          "2DqAH2dkZBZ8vDrXfnCFH1qwGd9",
+		User:        user.Email,
+		Filename:    "photo.jpeg",
+		Key:         "2DqAH2dkZBZ8vDrXfnCFH1qwGd9_upload",
+		ContentType: "image/jpeg",
+		Size:        int64(len(photo)),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+
+	if err := s.DB.AddUploadSlot(ctx, &slot); err != nil {
+		t.Fatalf("failed to add upload slot: %s", err)
+	}
+
+	if err := s.Storage.Put(ctx, slot.Key, bytes.NewReader(photo)); err != nil {
+		t.Fatalf("failed to upload photo: %s", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/upload-slots/"+slot.ID+"/finalize", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	finalized := models.Photo{}
+	if err := json.Unmarshal(w.Body.Bytes(), &finalized); err != nil {
+		t.Fatalf("failed to decode response: %s", err)
+	}
+
+	if finalized.Key != slot.Key {
+		t.Errorf("expected the photo to keep the uploaded object %s, got %s", slot.Key, finalized.Key)
+	}
+
+	// Nothing the photo uses is waiting to be deleted
+	if _, err := s.PurgeDeletedObjects(ctx); err != nil {
+		t.Fatalf("failed to purge deleted objects: %s", err)
+	}
+
+	if _, err := s.Storage.Stat(ctx, slot.Key); err != nil {
+		t.Errorf("expected the uploaded object to still be in storage, got %s", err)
+	}
+
+	if _, err := s.DB.DeleteExpiredUploadSlots(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("failed to delete expired upload slots: %s", err)
+	}
+
+	if _, err := s.PurgeDeletedObjects(ctx); err != nil {
+		t.Fatalf("failed to purge deleted objects: %s", err)
+	}
+
+	if _, err := s.Storage.Stat(ctx, slot.Key); err != nil {
+		t.Errorf("expected the uploaded object to outlive its slot, got %s", err)
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// EXIF_PREFIX is how much of the start of a photo is kept for reading EXIF data once the photo has been streamed
+// to storage. JPEG keeps EXIF data in a segment of at most 64KB near the start of the file.
+const EXIF_PREFIX = 256 << 10
+
+var errPhotoTooLarge = errors.New("photo is too large")
+
+// photoTypes maps the content types that can be sniffed from the start of an upload to the image formats that
+// can be decoded
+var photoTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// photoStream reads an uploaded photo, failing once more than limit bytes have been read, and keeps what is
+// needed once the photo has been read: its size, its SHA-256 digest and the start of the file
+type photoStream struct {
+	r     io.Reader
+	limit int64
+
+	size     int64
+	tooLarge bool
+	hash     hash.Hash
+	prefix   []byte
+
+	// err is why reading the upload failed, as opposed to the photo being invalid
+	err error
+}
+
+func newPhotoStream(r io.Reader, limit int64) *photoStream {
+	return &photoStream{r: r, limit: limit, hash: sha256.New()}
+}
+
+func (p *photoStream) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+
+	if err != nil && err != io.EOF {
+		p.err = err
+
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			p.tooLarge = true
+		}
+	}
+
+	if p.size+int64(n) > p.limit {
+		n = int(p.limit - p.size)
+		p.tooLarge = true
+		err = errPhotoTooLarge
+	}
+
+	p.size += int64(n)
+	p.hash.Write(b[:n])
+
+	if keep := EXIF_PREFIX - len(p.prefix); keep > 0 {
+		if keep > n {
+			keep = n
+		}
+
+		p.prefix = append(p.prefix, b[:keep]...)
+	}
+
+	return n, err
+}
+
+// Sum returns the hex encoded SHA-256 digest of everything read so far
+func (p *photoStream) Sum() string {
+	return hex.EncodeToString(p.hash.Sum(nil))
+}
+
+// uploadWriter streams whatever is written to it into storage. Writes fail once storage has failed, and err
+// records why so that a failed write can be told apart from a bad photo.
+type uploadWriter struct {
+	pipe *io.PipeWriter
+	done chan error
+	err  error
+}
+
+// startUpload starts writing an object to storage, which finishes once the writer is closed
+func (s *Server) startUpload(ctx context.Context, key string) *uploadWriter {
+	reader, writer := io.Pipe()
+	upload := &uploadWriter{pipe: writer, done: make(chan error, 1)}
+
+	go func() {
+		err := s.Storage.Put(ctx, key, reader)
+		reader.CloseWithError(err)
+		upload.done <- err
+	}()
+
+	return upload
+}
+
+func (u *uploadWriter) Write(b []byte) (int, error) {
+	n, err := u.pipe.Write(b)
+	if err != nil && u.err == nil {
+		u.err = err
+	}
+
+	return n, err
+}
+
+// Close finishes the object and waits for storage to store it
+func (u *uploadWriter) Close() error {
+	u.pipe.Close()
+	if err := <-u.done; err != nil {
+		return err
+	}
+
+	return u.err
+}
+
+// Abort stops the upload so that nothing is stored
+func (u *uploadWriter) Abort(err error) {
+	u.pipe.CloseWithError(err)
+	<-u.done
+}
+
+// storageReadError is a failure to read an upload that was staged in storage, which is the server's fault rather
+// than the client's
+type storageReadError struct {
+	err error
+}
+
+func (e storageReadError) Error() string {
+	return "failed to read from storage: " + e.err.Error()
+}
+
+func (e storageReadError) Unwrap() error {
+	return e.err
+}
+
+// objectsReader reads a series of objects from storage one after another, opening each one only once the one
+// before it has been read
+type objectsReader struct {
+	s    *Server
+	ctx  context.Context
+	keys []string
+
+	current io.ReadCloser
+}
+
+func (o *objectsReader) Read(b []byte) (int, error) {
+	for {
+		if o.current == nil {
+			if len(o.keys) == 0 {
+				return 0, io.EOF
+			}
+
+			body, err := o.s.Storage.Get(o.ctx, o.keys[0])
+			if err != nil {
+				return 0, storageReadError{err}
+			}
+
+			o.current, o.keys = body, o.keys[1:]
+		}
+
+		n, err := o.current.Read(b)
+		if err == io.EOF {
+			o.current.Close()
+			o.current = nil
+			err = nil
+		}
+
+		if err != nil {
+			return n, storageReadError{err}
+		}
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the object being read, if any
+func (o *objectsReader) Close() error {
+	if o.current == nil {
+		return nil
+	}
+
+	return o.current.Close()
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/yanchenm/photo-sync/db"
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// Resumable uploads implement the tus 1.0 protocol (https://tus.io/protocols/resumable-upload) with the creation,
+// expiration and termination extensions. Each PATCH request is staged in storage as a separate chunk, and the
+// photo is created from the chunks once the last byte has arrived.
+const (
+	TUS_VERSION    = "1.0.0"
+	TUS_EXTENSIONS = "creation,expiration,termination"
+	TUS_CHUNK_TYPE = "application/offset+octet-stream"
+
+	// UPLOAD_EXPIRY is how long an unfinished upload is kept after its last chunk arrived
+	UPLOAD_EXPIRY = 24 * time.Hour
+
+	// PHOTO_ID_HEADER tells the client which photo a finished upload created
+	PHOTO_ID_HEADER = "X-Photo-ID"
+)
+
+// tusHeaders are the response headers browsers must be allowed to read for tus clients to work
+var tusHeaders = []string{
+	"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Offset", "Upload-Length",
+	"Upload-Expires", PHOTO_ID_HEADER,
+}
+
+// tusResumable is router middleware for the upload endpoints that rejects clients speaking another version of the
+// protocol and marks every response with the version spoken here
+func (s *Server) tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", TUS_VERSION)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != TUS_VERSION {
+			w.Header().Set("Tus-Version", TUS_VERSION)
+			respondWithError(w, r, http.StatusPreconditionFailed, "unsupported tus version")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleUploadOptions describes the protocol supported by the upload endpoints
+func (s *Server) handleUploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", TUS_VERSION)
+	w.Header().Set("Tus-Extension", TUS_EXTENSIONS)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(s.Config.Upload.MaxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header, a comma separated list of keys and base64 values
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid metadata %q", pair)
+		}
+
+		value := ""
+		if len(fields) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid metadata value for %s: %w", fields[0], err)
+			}
+
+			value = string(decoded)
+		}
+
+		metadata[fields[0]] = value
+	}
+
+	return metadata, nil
+}
+
+func (s *Server) handleCreateUpload(w http.ResponseWriter, r *http.Request, user models.User) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		respondWithError(w, r, http.StatusBadRequest, "the upload length must be given up front")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid upload length", err)
+		return
+	}
+
+	if length > s.Config.Upload.MaxSize {
+		respondWithHTTPError(w, r, s.tooLargeError(nil))
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid upload metadata", err)
+		return
+	}
+
+	// tus clients disagree on what to call the file name
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+
+	if fileName == "" {
+		respondWithError(w, r, http.StatusBadRequest, "missing filename in upload metadata")
+		return
+	}
+
+	upload := models.Upload{
+		ID:        ksuid.New().String(),
+		User:      user.Email,
+		Filename:  fileName,
+		Length:    length,
+		ExpiresAt: time.Now().Add(UPLOAD_EXPIRY),
+	}
+
+	addLogFields(r, log.Fields{"upload_id": upload.ID})
+	addSpanAttributes(r, attribute.String("upload_id", upload.ID))
+
+	if err := s.DB.AddUpload(r.Context(), &upload); err != nil {
+		respondWithDBError(w, r, err, "upload", "failed to create upload")
+		return
+	}
+
+	location, err := s.Router.Get("upload").URL("id", upload.ID)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to create upload url", err)
+		return
+	}
+
+	w.Header().Set("Location", location.String())
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getUpload loads the upload named in the request. Uploads belonging to other users are reported as missing, and
+// unfinished uploads that have expired as gone. If the upload can't be loaded, an error response is written and
+// false is returned.
+func (s *Server) getUpload(w http.ResponseWriter, r *http.Request, user models.User) (models.Upload, bool) {
+	upload, err := s.DB.GetUpload(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		respondWithDBError(w, r, err, "upload", "failed to get upload")
+		return upload, false
+	}
+
+	if upload.User != user.Email {
+		respondWithError(w, r, http.StatusNotFound, "upload does not exist")
+		return upload, false
+	}
+
+	if upload.Expired() {
+		respondWithError(w, r, http.StatusGone, "upload has expired")
+		return upload, false
+	}
+
+	return upload, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload models.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+
+	if upload.PhotoID != "" {
+		w.Header().Set(PHOTO_ID_HEADER, upload.PhotoID)
+	} else {
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// handleGetUploadOffset tells a client where to resume an interrupted upload
+func (s *Server) handleGetUploadOffset(w http.ResponseWriter, r *http.Request, user models.User) {
+	upload, ok := s.getUpload(w, r, user)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePatchUpload stages the chunk in the request body and creates the photo once the whole file has arrived.
+// Whatever part of the chunk arrived before the client went away is kept, so that the client can carry on from
+// there.
+func (s *Server) handlePatchUpload(w http.ResponseWriter, r *http.Request, user models.User) {
+	upload, ok := s.getUpload(w, r, user)
+	if !ok {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != TUS_CHUNK_TYPE {
+		respondWithError(w, r, http.StatusUnsupportedMediaType, "chunks must be sent as "+TUS_CHUNK_TYPE)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid upload offset", err)
+		return
+	}
+
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		respondWithError(w, r, http.StatusConflict, "upload offset does not match")
+		return
+	}
+
+	if upload.PhotoID == "" && !upload.Received() {
+		if !s.stageChunk(w, r, &upload) {
+			return
+		}
+	}
+
+	// Finishing is retried by sending an empty chunk at the end of the upload, if it failed the first time
+	if upload.PhotoID == "" && upload.Received() {
+		if !s.finishUpload(w, r, user, &upload) {
+			return
+		}
+	}
+
+	setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errChunkTooLarge stops staging a chunk that runs past the end of the upload
+var errChunkTooLarge = errors.New("chunk is larger than the rest of the upload")
+
+// chunkReader counts the bytes of a chunk as it is streamed to storage, failing once more than limit bytes arrive.
+// A body that is cut short ends the chunk instead of failing it, and err records why.
+type chunkReader struct {
+	r     io.Reader
+	limit int64
+
+	size     int64
+	tooLarge bool
+	err      error
+}
+
+func newChunkReader(r io.Reader, limit int64) *chunkReader {
+	return &chunkReader{r: io.LimitReader(r, limit+1), limit: limit}
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.size += int64(n)
+
+	if c.size > c.limit {
+		c.tooLarge = true
+		return n, errChunkTooLarge
+	}
+
+	if err != nil && err != io.EOF {
+		c.err = err
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+// stageChunk streams the request body to storage as the next chunk of upload and advances its offset, so that a
+// chunk is never held in memory. If the chunk can't be staged, an error response is written and false is returned.
+func (s *Server) stageChunk(w http.ResponseWriter, r *http.Request, upload *models.Upload) bool {
+	// Every chunk gets its own key so that a request that loses a race can't overwrite the winner's chunk
+	key := upload.ID + "_part_" + ksuid.New().String()
+	chunk := newChunkReader(r.Body, upload.Length-upload.Offset)
+
+	_, receiveSpan := tracer.Start(r.Context(), "upload.receive")
+	err := s.Storage.Put(r.Context(), key, chunk)
+	receiveSpan.SetAttributes(attribute.Int64("chunk.size", chunk.size))
+	receiveSpan.End()
+
+	switch {
+	case chunk.tooLarge:
+		s.discardObjects(r, key)
+		respondWithError(w, r, http.StatusRequestEntityTooLarge, "chunk is larger than the rest of the upload")
+		return false
+	case err != nil:
+		s.discardObjects(r, key)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to stage chunk", err)
+		return false
+	case chunk.size == 0:
+		s.discardObjects(r, key)
+		if chunk.err != nil {
+			logErrorAndRespond(w, r, http.StatusBadRequest, "failed to read chunk", chunk.err)
+			return false
+		}
+
+		return true
+	}
+
+	if chunk.err != nil {
+		logger(r).WithError(chunk.err).WithField("bytes", chunk.size).Warn("chunk was cut short, keeping what arrived")
+	}
+
+	// The offset only moves on by what storage actually holds
+	info, err := s.Storage.Stat(r.Context(), key)
+	if err == nil && info.Size != chunk.size {
+		err = fmt.Errorf("stored %d bytes of a %d byte chunk", info.Size, chunk.size)
+	}
+
+	if err != nil {
+		s.discardObjects(r, key)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to stage chunk", err)
+		return false
+	}
+
+	expiresAt := time.Now().Add(UPLOAD_EXPIRY)
+	if err := s.DB.AddUploadChunk(r.Context(), upload.ID, upload.Offset, key, chunk.size, expiresAt); err != nil {
+		s.discardObjects(r, key)
+
+		if errors.Is(err, db.ErrConflict) {
+			respondWithError(w, r, http.StatusConflict, "upload offset does not match")
+			return false
+		}
+
+		respondWithDBError(w, r, err, "upload", "failed to record chunk")
+		return false
+	}
+
+	upload.Offset += chunk.size
+	upload.ExpiresAt = expiresAt
+
+	return true
+}
+
+// finishUpload creates the photo from the staged chunks of a fully received upload, streaming them back from
+// storage in order. If the photo can't be created, an error response is written and false is returned, and the
+// chunks are kept so that finishing can be retried.
+func (s *Server) finishUpload(w http.ResponseWriter, r *http.Request, user models.User, upload *models.Upload) bool {
+	keys, err := s.DB.GetUploadChunks(r.Context(), upload.ID)
+	if err != nil {
+		respondWithDBError(w, r, err, "upload", "failed to get upload chunks")
+		return false
+	}
+
+	chunks := &objectsReader{s: s, ctx: r.Context(), keys: keys}
+	defer chunks.Close()
+
+	photo, _, saveErr := s.savePhoto(r, user, upload.Filename, chunks)
+	if saveErr != nil {
+		respondWithHTTPError(w, r, saveErr)
+		return false
+	}
+
+	upload.PhotoID = photo.ID
+
+	// The photo exists now, so failing to tidy up the upload shouldn't fail the request. Chunks that are left
+	// behind are deleted when the upload expires.
+	if err := s.DB.CompleteUpload(r.Context(), upload.ID, photo.ID); err != nil {
+		logger(r).WithError(err).Error("failed to complete upload")
+		return true
+	}
+
+	ctx, cancel := detach(r.Context())
+	defer cancel()
+
+	if _, err := s.purgeObjects(ctx, keys); err != nil {
+		logger(r).WithError(err).Warn("failed to delete upload chunks from storage, it will be retried")
+	}
+
+	return true
+}
+
+// handleDeleteUpload abandons an upload and deletes its staged chunks
+func (s *Server) handleDeleteUpload(w http.ResponseWriter, r *http.Request, user models.User) {
+	upload, ok := s.getUpload(w, r, user)
+	if !ok {
+		return
+	}
+
+	keys, err := s.DB.GetUploadChunks(r.Context(), upload.ID)
+	if err != nil {
+		respondWithDBError(w, r, err, "upload", "failed to get upload chunks")
+		return
+	}
+
+	// Deleting the upload also queues its chunks for deletion, so the upload is gone as soon as this succeeds
+	if err := s.DB.DeleteUpload(r.Context(), upload.ID); err != nil {
+		respondWithDBError(w, r, err, "upload", "failed to delete upload")
+		return
+	}
+
+	ctx, cancel := detach(r.Context())
+	defer cancel()
+
+	if _, err := s.purgeObjects(ctx, keys); err != nil {
+		logger(r).WithError(err).Warn("failed to delete upload chunks from storage, it will be retried")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yanchenm/photo-sync/models"
+)
+
+// createUpload starts a resumable upload of length bytes and returns its location
+func createUpload(t *testing.T, s *Server, token string, length int) string {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Tus-Resumable", TUS_VERSION)
+	r.Header.Set("Upload-Length", strconv.Itoa(length))
+	r.Header.Set("Upload-Metadata", "filename cGhvdG8uanBlZw==")
+
+	w := serve(s, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status 201 creating the upload, got %d: %s", w.Code, w.Body)
+	}
+
+	return w.Header().Get("Location")
+}
+
+// patchUpload sends a chunk of a resumable upload from offset
+func patchUpload(s *Server, token, location string, offset int, chunk io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, location, chunk)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Tus-Resumable", TUS_VERSION)
+	r.Header.Set("Content-Type", TUS_CHUNK_TYPE)
+	r.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	return serve(s, r)
+}
+
+// uploadOffset asks where a resumable upload should carry on from
+func uploadOffset(t *testing.T, s *Server, token, location string) int {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodHead, location, nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Tus-Resumable", TUS_VERSION)
+
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 getting the offset, got %d: %s", w.Code, w.Body)
+	}
+
+	offset, err := strconv.Atoi(w.Header().Get("Upload-Offset"))
+	if err != nil {
+		t.Fatalf("invalid upload offset: %s", err)
+	}
+
+	return offset
+}
+
+// brokenReader fails as though the client went away
+type brokenReader struct{}
+
+func (brokenReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := newTestServer(t)
+	_, token := addTestUser(t, s, "owner@example.com")
+	photo := testJPEG(t, 4)
+	half := len(photo) / 2
+
+	location := createUpload(t, s, token, len(photo))
+
+	// A chunk that is cut short keeps what arrived
+	if w := patchUpload(s, token, location, 0, io.MultiReader(bytes.NewReader(photo[:half]), brokenReader{})); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 for a partial chunk, got %d: %s", w.Code, w.Body)
+	}
+
+	offset := uploadOffset(t, s, token, location)
+	if offset != half {
+		t.Fatalf("expected to resume from %d, got %d", half, offset)
+	}
+
+	w := patchUpload(s, token, location, 0, bytes.NewReader(photo))
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Errorf("expected status 409 and the offset for a chunk at the wrong offset, got %d at %s: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+
+	tooLong := append(append([]byte{}, photo[offset:]...), 0)
+	if w := patchUpload(s, token, location, offset, bytes.NewReader(tooLong)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for a chunk past the end of the upload, got %d: %s", w.Code, w.Body)
+	}
+
+	if got := uploadOffset(t, s, token, location); got != offset {
+		t.Fatalf("expected rejected chunks to leave the offset at %d, got %d", offset, got)
+	}
+
+	// The final chunk creates the photo
+	w = patchUpload(s, token, location, offset, bytes.NewReader(photo[offset:]))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204 for the final chunk, got %d: %s", w.Code, w.Body)
+	}
+
+	id := w.Header().Get(PHOTO_ID_HEADER)
+	if id == "" {
+		t.Fatal("expected the final chunk to return the photo id")
+	}
+
+	created, err := s.DB.GetPhotoWithDetail(context.Background(), id)
+	if err != nil {
+		t.Fatalf("expected the photo to exist, got %s", err)
+	}
+
+	if created.Filename != "photo.jpeg" {
+		t.Errorf("expected the photo to be called photo.jpeg, got %s", created.Filename)
+	}
+
+	info, err := s.Storage.Stat(context.Background(), created.Key)
+	if err != nil || info.Size != int64(len(photo)) {
+		t.Errorf("expected all %d bytes of the photo to be stored, got %+v: %v", len(photo), info, err)
+	}
+}
+
+func TestExpiredUploadIsGone(t *testing.T) {
+	s := newTestServer(t)
+	user, token := addTestUser(t, s, "owner@example.com")
+
+	upload := models.Upload{
+		ID:        "2DqGbE1mUqNBz6sB1L0ZJv1uhX9",
+		User:      user.Email,
+		Filename:  "photo.jpeg",
+		Length:    100,
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}
+
+	if err := s.DB.AddUpload(context.Background(), &upload); err != nil {
+		t.Fatalf("failed to add upload: %s", err)
+	}
+
+	if w := patchUpload(s, token, "/uploads/"+upload.ID, 0, bytes.NewReader(make([]byte, 10))); w.Code != http.StatusGone {
+		t.Errorf("expected status 410 for an expired upload, got %d: %s", w.Code, w.Body)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 
 	"github.com/gorilla/mux"
 
@@ -12,15 +11,15 @@ import (
 )
 
 func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
-	if os.Getenv("DISABLE_SIGN_UP") != "false" {
-		respondWithError(w, http.StatusForbidden, "you can't do that")
+	if s.Config.DisableSignUp {
+		respondWithError(w, r, http.StatusForbidden, "you can't do that")
 		return
 	}
 
 	user := models.User{}
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&user); err != nil {
-		logErrorAndRespond(w, http.StatusBadRequest, "invalid request payload", err)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "invalid request payload", err)
 		return
 	}
 
@@ -36,17 +35,17 @@ func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		logErrorAndRespond(w, http.StatusBadRequest, "missing required fields", fmt.Errorf("%v", missing))
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing required fields", fmt.Errorf("%v", missing))
 		return
 	}
 
 	if err := user.HashPassword(); err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to process password", err)
+		logErrorAndRespond(w, r, http.StatusInternalServerError, "failed to process password", err)
 		return
 	}
 
-	if err := s.DB.AddUser(&user); err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to create user", err)
+	if err := s.DB.AddUser(r.Context(), &user); err != nil {
+		respondWithDBError(w, r, err, "user", "failed to create user")
 		return
 	}
 
@@ -55,9 +54,9 @@ func (s *Server) handleAddUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleGetAuthenticatedUser(w http.ResponseWriter, r *http.Request, authUser models.User) {
-	user, err := s.DB.GetUserFromEmail(authUser.Email)
+	user, err := s.DB.GetUserFromEmail(r.Context(), authUser.Email)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get user details", err)
+		respondWithDBError(w, r, err, "user", "failed to get user details")
 		return
 	}
 
@@ -70,12 +69,13 @@ func (s *Server) handleGetUserByEmail(w http.ResponseWriter, r *http.Request, _
 	email := params["email"]
 
 	if email == "" {
-		logErrorAndRespond(w, http.StatusBadRequest, "missing or invalid email", nil)
+		logErrorAndRespond(w, r, http.StatusBadRequest, "missing or invalid email", nil)
+		return
 	}
 
-	user, err := s.DB.GetUserFromEmail(email)
+	user, err := s.DB.GetUserFromEmail(r.Context(), email)
 	if err != nil {
-		logErrorAndRespond(w, http.StatusInternalServerError, "failed to get user details", err)
+		respondWithDBError(w, r, err, "user", "failed to get user details")
 		return
 	}
 
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const LocalURLPrefix = "/files/"
+
+// Local stores objects on disk under Root. Signed URLs point back at the API
+// itself, which serves them through ServeHTTP after verifying the signature.
+type Local struct {
+	Root    string
+	BaseURL string
+
+	key []byte
+}
+
+func NewLocal(root, baseURL string, signingKey []byte) (*Local, error) {
+	if len(signingKey) == 0 {
+		return nil, fmt.Errorf("local storage requires a signing key")
+	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Local{
+		Root:    root,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		key:     signingKey,
+	}, nil
+}
+
+func (l *Local) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if key == "" || clean == "/" || clean[1:] != key {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+
+	return filepath.Join(l.Root, filepath.FromSlash(clean)), nil
+}
+
+func (l *Local) Put(_ context.Context, key string, body io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *Local) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return file, err
+}
+
+func (l *Local) Delete(_ context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (l *Local) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotFound
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (l *Local) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(l.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		key, err := filepath.Rel(l.Root, path)
+		if err != nil {
+			return err
+		}
+
+		return fn(ObjectInfo{
+			Key:          filepath.ToSlash(key),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+	})
+}
+
+func (l *Local) SignedURL(_ context.Context, key, fileName string, expiry time.Duration) (string, error) {
+	if _, err := l.path(key); err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+
+	params := url.Values{}
+	params.Set("expires", expires)
+	params.Set("filename", fileName)
+	params.Set("signature", l.sign(key, fileName, expires))
+
+	return l.BaseURL + LocalURLPrefix + key + "?" + params.Encode(), nil
+}
+
+func (l *Local) SignedUploadURL(_ context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedUpload, error) {
+	if _, err := l.path(key); err != nil {
+		return PresignedUpload{}, err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	length := strconv.FormatInt(size, 10)
+
+	params := url.Values{}
+	params.Set("expires", expires)
+	params.Set("signature", l.signUpload(key, contentType, length, expires))
+
+	return PresignedUpload{
+		URL:    l.BaseURL + LocalURLPrefix + key + "?" + params.Encode(),
+		Method: http.MethodPut,
+		Headers: map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": length,
+		},
+	}, nil
+}
+
+func (l *Local) Ping(_ context.Context) error {
+	info, err := os.Stat(l.Root)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", l.Root)
+	}
+
+	return nil
+}
+
+func (l *Local) sign(key, fileName, expires string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(key + "\n" + fileName + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signUpload covers the method as well, so that a download signature can't be used to upload
+func (l *Local) signUpload(key, contentType, length, expires string) string {
+	mac := hmac.New(sha256.New, l.key)
+	mac.Write([]byte(http.MethodPut + "\n" + key + "\n" + contentType + "\n" + length + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a signature from a signed URL and that the URL hasn't expired, writing an error response if not
+func verify(w http.ResponseWriter, signature, expected, expires string) bool {
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return false
+	}
+
+	want, _ := hex.DecodeString(expected)
+	if !hmac.Equal(given, want) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		http.Error(w, "url has expired", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// ServeHTTP serves objects requested through URLs generated by SignedURL, and stores objects uploaded through
+// URLs generated by SignedUploadURL.
+func (l *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, LocalURLPrefix)
+	if r.Method == http.MethodPut {
+		l.serveUpload(w, r, key)
+		return
+	}
+
+	query := r.URL.Query()
+
+	expires := query.Get("expires")
+	fileName := query.Get("filename")
+	if !verify(w, query.Get("signature"), l.sign(key, fileName, expires), expires) {
+		return
+	}
+
+	path, err := l.path(key)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	http.ServeContent(w, r, key, info.ModTime(), file)
+}
+
+// serveUpload stores an object uploaded with a PUT request, which must have the content type and length that were
+// signed
+func (l *Local) serveUpload(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	expires := query.Get("expires")
+	length := strconv.FormatInt(r.ContentLength, 10)
+	if !verify(w, query.Get("signature"), l.signUpload(key, r.Header.Get("Content-Type"), length, expires), expires) {
+		return
+	}
+
+	if err := l.Put(r.Context(), key, http.MaxBytesReader(w, r.Body, r.ContentLength)); err != nil {
+		http.Error(w, "failed to store object", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
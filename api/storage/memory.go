@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data         []byte
+	lastModified time.Time
+}
+
+// Memory keeps objects in a map and is intended for tests.
+type Memory struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+func NewMemory() *Memory {
+	return &Memory{objects: make(map[string]memoryObject)}
+}
+
+func (m *Memory) Put(_ context.Context, key string, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[key] = memoryObject{data: data, lastModified: time.Now()}
+	return nil
+}
+
+func (m *Memory) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (m *Memory) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *Memory) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         int64(len(obj.data)),
+		LastModified: obj.lastModified,
+	}, nil
+}
+
+func (m *Memory) List(_ context.Context, fn func(ObjectInfo) error) error {
+	m.mu.RLock()
+	infos := make([]ObjectInfo, 0, len(m.objects))
+	for key, obj := range m.objects {
+		infos = append(infos, ObjectInfo{Key: key, Size: int64(len(obj.data)), LastModified: obj.lastModified})
+	}
+	m.mu.RUnlock()
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) SignedURL(_ context.Context, key, fileName string, expiry time.Duration) (string, error) {
+	params := url.Values{}
+	params.Set("expires", strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+	params.Set("filename", fileName)
+
+	return "memory:///" + key + "?" + params.Encode(), nil
+}
+
+func (m *Memory) SignedUploadURL(_ context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedUpload, error) {
+	params := url.Values{}
+	params.Set("expires", strconv.FormatInt(time.Now().Add(expiry).Unix(), 10))
+
+	return PresignedUpload{
+		URL:    "memory:///" + key + "?" + params.Encode(),
+		Method: http.MethodPut,
+		Headers: map[string]string{
+			"Content-Type":   contentType,
+			"Content-Length": strconv.FormatInt(size, 10),
+		},
+	}, nil
+}
+
+func (m *Memory) Ping(_ context.Context) error {
+	return nil
+}
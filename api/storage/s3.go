@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+type S3 struct {
+	Bucket string
+
+	sess *session.Session
+	svc  *s3.S3
+}
+
+func NewS3(region, bucket string) (*S3, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(region),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		Bucket: bucket,
+		sess:   sess,
+		svc:    s3.New(sess),
+	}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader) error {
+	uploader := s3manager.NewUploaderWithClient(s.svc)
+
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+
+	return err
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, translateS3Error(err)
+	}
+
+	return out.Body, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+
+	return translateS3Error(err)
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	out, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, translateS3Error(err)
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+func (s *S3) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	var fnErr error
+	err := s.svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+	}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			fnErr = fn(ObjectInfo{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				LastModified: aws.TimeValue(obj.LastModified),
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+
+	return translateS3Error(err)
+}
+
+func (s *S3) SignedURL(_ context.Context, key, fileName string, expiry time.Duration) (string, error) {
+	fileNameParam := fmt.Sprintf("attachment; filename=\"%s\"", fileName)
+	req, _ := s.svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket:                     aws.String(s.Bucket),
+		Key:                        aws.String(key),
+		ResponseContentDisposition: aws.String(fileNameParam),
+	})
+
+	return req.Presign(expiry)
+}
+
+// SignedUploadURL presigns a PutObject request. The content type and length are part of the signature, so S3
+// rejects an upload of any other type or size.
+func (s *S3) SignedUploadURL(_ context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedUpload, error) {
+	req, _ := s.svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	})
+
+	signedUrl, signedHeaders, err := req.PresignRequest(expiry)
+	if err != nil {
+		return PresignedUpload{}, err
+	}
+
+	headers := make(map[string]string, len(signedHeaders))
+	for name := range signedHeaders {
+		headers[name] = signedHeaders.Get(name)
+	}
+
+	return PresignedUpload{URL: signedUrl, Method: http.MethodPut, Headers: headers}, nil
+}
+
+func (s *S3) Ping(ctx context.Context) error {
+	_, err := s.svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s.Bucket),
+	})
+
+	return err
+}
+
+func translateS3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrNotFound
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// PresignedUpload is a request that uploads an object without further authentication. The request must be made
+// with Method and every header in Headers.
+type PresignedUpload struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Storage is a blob store for original photos and thumbnails.
+type Storage interface {
+	Put(ctx context.Context, key string, body io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete succeeds if the object doesn't exist, so that deletions can be retried.
+	Delete(ctx context.Context, key string) error
+
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+
+	// List calls fn for every object in the store, in no particular order, and stops at the first error fn
+	// returns. fn may delete the object it is given.
+	List(ctx context.Context, fn func(ObjectInfo) error) error
+
+	// SignedURL returns a URL that allows the object to be downloaded as fileName
+	// without further authentication until expiry has passed.
+	SignedURL(ctx context.Context, key, fileName string, expiry time.Duration) (string, error)
+
+	// SignedUploadURL returns a request that uploads an object of exactly size bytes and the given content type
+	// to key without further authentication until expiry has passed.
+	SignedUploadURL(ctx context.Context, key, contentType string, size int64, expiry time.Duration) (PresignedUpload, error)
+
+	// Ping checks that the store can be reached and its bucket or directory exists.
+	Ping(ctx context.Context) error
+}